@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/langchain-ai/ls-go-run-handler/internal/wal"
+)
+
+// errQueueFull signals backpressure: the caller should retry later.
+var errQueueFull = errors.New("ingest queue is full, retry later")
+
+const (
+	flushBackoffMin = 100 * time.Millisecond
+	flushBackoffMax = 30 * time.Second
+	// flushMaxAttempts bounds the retries of one batch, about six minutes with the
+	// backoff above, after which the batch is quarantined.
+	flushMaxAttempts = 20
+)
+
+// pendingBatch is a batch accepted into the write-ahead log but not yet flushed.
+type pendingBatch struct {
+	walID     string
+	objectKey string
+	body      []byte
+	offs      []runOffsets
+}
+
+// walMeta is the JSON header persisted alongside each batch body in the WAL.
+type walMeta struct {
+	ObjectKey string       `json:"object_key"`
+	Runs      []walMetaRun `json:"runs"`
+}
+
+type walMetaRun struct {
+	ID       uuid.UUID `json:"id"`
+	TraceID  uuid.UUID `json:"trace_id"`
+	Name     string    `json:"name"`
+	Inputs   [2]int    `json:"inputs"`
+	Outputs  [2]int    `json:"outputs"`
+	Metadata [2]int    `json:"metadata"`
+	Tags     []string  `json:"tags,omitempty"`
+}
+
+// writeBehindQueue accepts batches durably and flushes them to S3 and Postgres in the
+// background. Runs stay readable from memory until their batch has been flushed.
+type writeBehindQueue struct {
+	srv  *Server
+	wal  *wal.Log
+	jobs chan *pendingBatch
+	// write stores a batch; it is srv.writeBatch outside of tests.
+	write func(ctx context.Context, objectKey string, body []byte, offs []runOffsets) ([]string, error)
+	// stopping is closed by stop; workers then take no new batches.
+	stopping chan struct{}
+
+	mu      sync.RWMutex
+	pending map[uuid.UUID]pendingRun
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// pendingRun points at one run inside a pending batch.
+type pendingRun struct {
+	batch *pendingBatch
+	offs  runOffsets
+}
+
+// newWriteBehindQueue opens the WAL, starts the flush workers and re-enqueues any
+// batches left over from a previous process.
+func newWriteBehindQueue(srv *Server, dir string, workers, size int) (*writeBehindQueue, error) {
+	l, err := wal.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if size < 1 {
+		size = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &writeBehindQueue{
+		srv:      srv,
+		wal:      l,
+		jobs:     make(chan *pendingBatch, size),
+		write:    srv.writeBatch,
+		stopping: make(chan struct{}),
+		pending:  make(map[uuid.UUID]pendingRun),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+
+	var replayed []*pendingBatch
+	err = l.Replay(func(id string, rec wal.Record, err error) error {
+		if err != nil {
+			quarantine(l, id, "unreadable", err)
+			return nil
+		}
+		pb, err := decodePendingBatch(id, rec, newIndexer(srv.settings()))
+		if err != nil {
+			quarantine(l, id, "undecodable", err)
+			return nil
+		}
+		q.track(pb)
+		replayed = append(replayed, pb)
+		return nil
+	})
+	if err != nil {
+		q.close()
+		return nil, err
+	}
+	if len(replayed) > 0 {
+		slog.Info("wal: replaying pending batches", "batches", len(replayed))
+		// Replayed batches may exceed the queue size; feed them without blocking startup.
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for _, pb := range replayed {
+				select {
+				case q.jobs <- pb:
+				case <-q.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return q, nil
+}
+
+// quarantine moves a segment that cannot be replayed out of the WAL, so that it is not
+// retried, and logged, on every start.
+func quarantine(l *wal.Log, id, reason string, cause error) {
+	path, err := l.Quarantine(id)
+	if err != nil {
+		slog.Error("wal: skipping "+reason+" segment; quarantine failed", "segment", id, "error", cause, "quarantine_error", err)
+		return
+	}
+	slog.Error("wal: quarantined "+reason+" segment", "segment", id, "path", path, "error", cause)
+}
+
+// enqueue durably records the batch and schedules it for flushing. body must not be
+// reused by the caller afterwards.
+func (q *writeBehindQueue) enqueue(objectKey string, body []byte, offs []runOffsets) error {
+	if len(q.jobs) == cap(q.jobs) {
+		return errQueueFull
+	}
+	pb := &pendingBatch{
+		walID:     fmt.Sprintf("%020d-%s", time.Now().UnixNano(), uuid.New().String()),
+		objectKey: objectKey,
+		body:      body,
+		offs:      offs,
+	}
+	meta, err := encodeWALMeta(pb)
+	if err != nil {
+		return fmt.Errorf("wal encode: %w", err)
+	}
+	if err := q.wal.Append(pb.walID, wal.Record{Meta: meta, Body: body}); err != nil {
+		return err
+	}
+	q.track(pb)
+	select {
+	case q.jobs <- pb:
+		return nil
+	default:
+		q.untrack(pb)
+		if err := q.wal.Remove(pb.walID); err != nil {
+			slog.Error("wal: remove rejected batch", "segment", pb.walID, "batch_key", pb.objectKey, "error", err)
+		}
+		return errQueueFull
+	}
+}
+
+// lookup returns the pending copy of a run, if it has not been flushed yet.
+func (q *writeBehindQueue) lookup(id uuid.UUID) (pendingRun, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	pr, ok := q.pending[id]
+	return pr, ok
+}
+
+func (q *writeBehindQueue) track(pb *pendingBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, ro := range pb.offs {
+		q.pending[ro.id] = pendingRun{batch: pb, offs: ro}
+	}
+}
+
+// untrack forgets the runs of pb, leaving entries that a newer batch has since replaced.
+func (q *writeBehindQueue) untrack(pb *pendingBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, ro := range pb.offs {
+		if pr, ok := q.pending[ro.id]; ok && pr.batch == pb {
+			delete(q.pending, ro.id)
+		}
+	}
+}
+
+func (q *writeBehindQueue) worker() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-q.stopping:
+			return
+		case pb := <-q.jobs:
+			q.process(pb)
+		}
+	}
+}
+
+// process flushes pb and removes it from the WAL once stored. A batch that cannot be
+// stored is quarantined, so that it neither blocks a worker nor comes back on every
+// start; one interrupted by shutdown stays in the WAL.
+func (q *writeBehindQueue) process(pb *pendingBatch) {
+	err := q.flush(pb)
+	switch {
+	case err == nil:
+		q.untrack(pb)
+		if err := q.wal.Remove(pb.walID); err != nil {
+			slog.Error("wal: remove flushed batch", "segment", pb.walID, "batch_key", pb.objectKey, "error", err)
+		}
+	case errors.Is(err, errShuttingDown) || q.ctx.Err() != nil:
+	default:
+		q.untrack(pb)
+		asyncFlushFailuresTotal.Inc()
+		quarantine(q.wal, pb.walID, "unflushable", err)
+	}
+}
+
+// flush writes pb to S3 and Postgres, retrying with exponential backoff until it
+// succeeds, fails permanently, runs out of attempts or the queue is closed. Retries
+// are safe because runs that are already stored are skipped.
+func (q *writeBehindQueue) flush(pb *pendingBatch) error {
+	backoff := flushBackoffMin
+	for attempt := 1; ; attempt++ {
+		if !q.srv.beginWrite() {
+			return errShuttingDown
+		}
+		_, err := q.write(q.ctx, pb.objectKey, pb.body, pb.offs)
+		q.srv.writes.Done()
+		if err == nil {
+			return nil
+		}
+		if permanentFlushError(err) {
+			return err
+		}
+		if attempt == flushMaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		slog.Warn("async flush failed", "batch_key", pb.objectKey, "runs", len(pb.offs), "attempt", attempt, "retry_in", backoff.String(), "error", err)
+		select {
+		case <-q.ctx.Done():
+			return q.ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, flushBackoffMax)
+	}
+}
+
+// permanentFlushError reports whether retrying a failed write cannot help: Postgres
+// rejected the rows themselves (data exception or integrity constraint violation).
+func permanentFlushError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
+
+// stop makes the workers exit once their current batch is done, leaving queued batches
+// in the WAL. A flush that is already in progress keeps going until close.
+func (q *writeBehindQueue) stop() {
+	close(q.stopping)
+}
+
+// close stops the workers. Unflushed batches remain in the WAL for the next start.
+func (q *writeBehindQueue) close() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+func encodeWALMeta(pb *pendingBatch) ([]byte, error) {
+	meta := walMeta{ObjectKey: pb.objectKey, Runs: make([]walMetaRun, 0, len(pb.offs))}
+	for _, ro := range pb.offs {
+		meta.Runs = append(meta.Runs, walMetaRun{
+			ID:       ro.id,
+			TraceID:  ro.traceID,
+			Name:     ro.name,
+			Inputs:   [2]int{ro.inputs.start, ro.inputs.end},
+			Outputs:  [2]int{ro.outputs.start, ro.outputs.end},
+			Metadata: [2]int{ro.metadata.start, ro.metadata.end},
+			Tags:     ro.tags,
+		})
+	}
+	return json.Marshal(meta)
+}
+
+// decodePendingBatch rebuilds a batch from its WAL record. Indexed columns are not
+// logged; ix derives them again from the body.
+func decodePendingBatch(id string, rec wal.Record, ix indexer) (*pendingBatch, error) {
+	var meta walMeta
+	if err := json.Unmarshal(rec.Meta, &meta); err != nil {
+		return nil, fmt.Errorf("decode meta: %w", err)
+	}
+	pb := &pendingBatch{walID: id, objectKey: meta.ObjectKey, body: rec.Body, offs: make([]runOffsets, 0, len(meta.Runs))}
+	for _, mr := range meta.Runs {
+		pb.offs = append(pb.offs, runOffsets{
+			id:       mr.ID,
+			traceID:  mr.TraceID,
+			name:     mr.Name,
+			inputs:   byteRange{start: mr.Inputs[0], end: mr.Inputs[1]},
+			outputs:  byteRange{start: mr.Outputs[0], end: mr.Outputs[1]},
+			metadata: byteRange{start: mr.Metadata[0], end: mr.Metadata[1]},
+			tags:     append([]string{}, mr.Tags...),
+		})
+		ro := &pb.offs[len(pb.offs)-1]
+		ix.index(ro, rec.Body[ro.inputs.start:ro.inputs.end], rec.Body[ro.outputs.start:ro.outputs.end], rec.Body[ro.metadata.start:ro.metadata.end])
+	}
+	return pb, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+	"github.com/langchain-ai/ls-go-run-handler/internal/wal"
+)
+
+// newIdleQueue returns a queue without workers, as if all of them were busy, so that
+// accepted batches stay pending and nothing touches S3 or Postgres.
+func newIdleQueue(t *testing.T, srv *Server, size int) *writeBehindQueue {
+	t.Helper()
+	l, err := wal.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &writeBehindQueue{
+		srv:      srv,
+		wal:      l,
+		jobs:     make(chan *pendingBatch, size),
+		write:    srv.writeBatch,
+		stopping: make(chan struct{}),
+		pending:  make(map[uuid.UUID]pendingRun),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func walSegments(t *testing.T, l *wal.Log) int {
+	t.Helper()
+	n := 0
+	if err := l.Replay(func(string, wal.Record, error) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWALMetaRoundTrip(t *testing.T) {
+	cfg := appconfig.Defaults()
+	ix := newIndexer(&cfg)
+	runs := []runJSON{
+		{TraceID: uuid.NewString(), Name: "a", Tags: []string{"prod"}, Inputs: json.RawMessage(`{"q":"hello"}`), Metadata: json.RawMessage(`{"model":"gpt-4"}`)},
+		{TraceID: uuid.NewString(), Name: "b", Outputs: json.RawMessage(`{"r":"world"}`)},
+	}
+	var buf bytes.Buffer
+	offs, err := buildBatch(&buf, runs, "", ix)
+	if err != nil {
+		t.Fatalf("buildBatch: %v", err)
+	}
+	pb := &pendingBatch{walID: "0001", objectKey: "batches/x.json", body: buf.Bytes(), offs: offs}
+	meta, err := encodeWALMeta(pb)
+	if err != nil {
+		t.Fatalf("encodeWALMeta: %v", err)
+	}
+	got, err := decodePendingBatch("0001", wal.Record{Meta: meta, Body: buf.Bytes()}, ix)
+	if err != nil {
+		t.Fatalf("decodePendingBatch: %v", err)
+	}
+	if got.objectKey != pb.objectKey || !reflect.DeepEqual(got.offs, pb.offs) {
+		t.Errorf("round trip differs:\n got %+v\nwant %+v", got.offs, pb.offs)
+	}
+	if _, err := decodePendingBatch("0002", wal.Record{Meta: []byte("not json")}, ix); err == nil {
+		t.Error("expected an error for undecodable metadata")
+	}
+}
+
+func TestAsyncIngest(t *testing.T) {
+	srv := newServer(appconfig.Defaults(), nil, nil)
+	srv.queue = newIdleQueue(t, srv, 1)
+	h := srv.routes()
+
+	post := func() *httptest.ResponseRecorder {
+		body := `[{"trace_id":"` + uuid.NewString() + `","name":"queued","tags":["prod"],"inputs":{"q":"hi"}}]`
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(body)))
+		return rec
+	}
+	rec := post()
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /runs: status %d, want 202: %s", rec.Code, rec.Body)
+	}
+	var accepted struct {
+		Status string   `json:"status"`
+		RunIDs []string `json:"run_ids"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &accepted); err != nil || accepted.Status != "accepted" || len(accepted.RunIDs) != 1 {
+		t.Fatalf("unexpected 202 body %s (%v)", rec.Body, err)
+	}
+
+	// The run is served from memory until it is flushed.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs/"+accepted.RunIDs[0], nil))
+	var run struct {
+		Name   string         `json:"name"`
+		Tags   []string       `json:"tags"`
+		Inputs map[string]any `json:"inputs"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &run)
+	if rec.Code != http.StatusOK || run.Name != "queued" || run.Inputs["q"] != "hi" || len(run.Tags) != 1 {
+		t.Errorf("pending run: status %d, body %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("pending run Cache-Control = %q, want no-store", got)
+	}
+
+	// The queue holds one batch, so the next one is pushed back.
+	rec = post()
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("full queue: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if n := walSegments(t, srv.queue.wal); n != 1 {
+		t.Errorf("WAL holds %d segments, want only the accepted batch", n)
+	}
+}
+
+func TestWALReplayQuarantines(t *testing.T) {
+	srv := newServer(appconfig.Defaults(), nil, nil)
+	// Refuse batch writes, so that replayed batches stay pending instead of reaching S3.
+	if err := srv.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	l, err := wal.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+	body := []byte(`[{"id":"` + id.String() + `"}]`)
+	pb := &pendingBatch{objectKey: "batches/x.json", body: body, offs: []runOffsets{{id: id, name: "replayed"}}}
+	meta, _ := encodeWALMeta(pb)
+	if err := l.Append("0001", wal.Record{Meta: meta, Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append("0002", wal.Record{Meta: []byte("not json")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "0003.wal"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := newWriteBehindQueue(srv, dir, 1, 4)
+	if err != nil {
+		t.Fatalf("newWriteBehindQueue: %v", err)
+	}
+	defer q.close()
+	if _, ok := q.lookup(id); !ok {
+		t.Error("replayed run is not pending")
+	}
+	for _, seg := range []string{"0002.wal", "0003.wal"} {
+		if _, err := os.Stat(filepath.Join(dir, wal.QuarantineDir, seg)); err != nil {
+			t.Errorf("%s not quarantined: %v", seg, err)
+		}
+	}
+	if n := walSegments(t, l); n != 1 {
+		t.Errorf("WAL holds %d segments after replay, want 1", n)
+	}
+}
+
+func TestFlushQuarantinesPermanentFailure(t *testing.T) {
+	srv := newServer(appconfig.Defaults(), nil, nil)
+	q := newIdleQueue(t, srv, 1)
+	calls := 0
+	q.write = func(context.Context, string, []byte, []runOffsets) ([]string, error) {
+		calls++
+		return nil, errors.Join(errors.New("s3 upload: ok"), fmt.Errorf("db copy: %w", &pgconn.PgError{Code: "22P02"}))
+	}
+	id := uuid.New()
+	if err := q.enqueue("batches/x.json", []byte(`[{}]`), []runOffsets{{id: id}}); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(asyncFlushFailuresTotal)
+	q.process(<-q.jobs)
+
+	if calls != 1 {
+		t.Errorf("write called %d times, want no retries of a permanent failure", calls)
+	}
+	if _, ok := q.lookup(id); ok {
+		t.Error("quarantined run is still pending")
+	}
+	if n := walSegments(t, q.wal); n != 0 {
+		t.Errorf("WAL holds %d segments, want the batch quarantined", n)
+	}
+	if got := testutil.ToFloat64(asyncFlushFailuresTotal) - before; got != 1 {
+		t.Errorf("async_flush_failures_total grew by %v, want 1", got)
+	}
+}
+
+func TestPermanentFlushError(t *testing.T) {
+	for err, want := range map[error]bool{
+		errors.New("connection refused"):                                      false,
+		&pgconn.PgError{Code: "40001"}:                                        false,
+		fmt.Errorf("db copy: %w", &pgconn.PgError{Code: "23505"}):             true,
+		errors.Join(nil, fmt.Errorf("x: %w", &pgconn.PgError{Code: "22021"})): true,
+	} {
+		if got := permanentFlushError(err); got != want {
+			t.Errorf("permanentFlushError(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/langchain-ai/ls-go-run-handler/internal/lru"
+)
+
+// batchCache keeps the bodies of recently written batch objects, so that reads of
+// freshly ingested runs are served from memory instead of downloading the bytes that
+// were just uploaded. Entries are evicted by total size and by age.
+type batchCache struct {
+	cache    *lru.Cache
+	maxBytes int
+}
+
+func newBatchCache(maxBytes int, ttl time.Duration) *batchCache {
+	return &batchCache{cache: lru.NewTTL(int64(maxBytes), ttl), maxBytes: maxBytes}
+}
+
+// add stores a copy of body, which is usually a pooled buffer, once the batch has been
+// stored. Bodies larger than the whole cache are skipped without copying.
+func (bc *batchCache) add(bucket, key string, body []byte) {
+	if bc == nil || len(body) > bc.maxBytes {
+		return
+	}
+	bc.cache.Add(bucket+"/"+key, bytes.Clone(body))
+}
+
+// get returns bytes [start, end) of a cached batch object.
+func (bc *batchCache) get(bucket, key string, start, end int) ([]byte, bool) {
+	if bc == nil {
+		return nil, false
+	}
+	body, ok := bc.cache.Get(bucket + "/" + key)
+	if !ok || end > len(body) {
+		batchCacheRequestsTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	batchCacheRequestsTotal.WithLabelValues("hit").Inc()
+	return body[start:end], true
+}
+
+// sizeGauge exports the bytes held by the cache.
+func (bc *batchCache) sizeGauge() prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_cache_bytes",
+		Help:      "Bytes of recently written batch objects held in memory.",
+	}, func() float64 { return float64(bc.cache.Size()) })
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatchCache(t *testing.T) {
+	bc := newBatchCache(64, time.Minute)
+	body := []byte(`[{"inputs":{"a":1}}]`)
+	bc.add("runs", "batches/a.json", body)
+	body[0] = 'x' // the cache keeps its own copy of pooled buffers
+
+	got, ok := bc.get("runs", "batches/a.json", 11, 18)
+	if !ok || string(got) != `{"a":1}` {
+		t.Fatalf("get = %q, %v", got, ok)
+	}
+	if _, ok := bc.get("runs", "batches/a.json", 11, 99); ok {
+		t.Error("range past the end of the object should miss")
+	}
+	if _, ok := bc.get("runs", "batches/b.json", 0, 1); ok {
+		t.Error("unknown object should miss")
+	}
+
+	bc.add("runs", "batches/big.json", make([]byte, 65))
+	if _, ok := bc.get("runs", "batches/big.json", 0, 1); ok {
+		t.Error("objects larger than the cache should not be stored")
+	}
+
+	var disabled *batchCache
+	disabled.add("runs", "k", body)
+	if _, ok := disabled.get("runs", "k", 0, 1); ok {
+		t.Error("nil cache should always miss")
+	}
+}
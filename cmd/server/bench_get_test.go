@@ -132,5 +132,31 @@ func BenchmarkGetRun(b *testing.B) {
 				}
 			}
 		})
+
+		// Revalidation with a current ETag: answered from Postgres alone
+		b.Run("etag_hit_"+cs.name, func(b *testing.B) {
+			rr, err := client.Get(ts.URL + "/runs/" + firstID)
+			if err != nil {
+				b.Fatalf("GET failed: %v", err)
+			}
+			io.Copy(io.Discard, rr.Body)
+			rr.Body.Close()
+			etag := rr.Header.Get("ETag")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req, _ := http.NewRequest(http.MethodGet, ts.URL+"/runs/"+firstID, nil)
+				req.Header.Set("If-None-Match", etag)
+				rr, err := client.Do(req)
+				if err != nil {
+					b.Fatalf("GET failed: %v", err)
+				}
+				io.Copy(io.Discard, rr.Body)
+				rr.Body.Close()
+				if rr.StatusCode != http.StatusNotModified {
+					b.Fatalf("unexpected %d", rr.StatusCode)
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// coalescer merges concurrent small POST /runs requests that arrive within a short
+// window into a single batch object and a single COPY. Each caller blocks until the
+// shared batch is written and then gets its own result. A zero window disables it.
+type coalescer struct {
+	srv *Server
+	// write stores a batch; it is srv.writeBatch outside of tests.
+	write func(ctx context.Context, objectKey string, body []byte, offs []runOffsets) ([]string, error)
+
+	mu       sync.Mutex
+	window   time.Duration
+	maxRuns  int
+	maxBytes int
+	cur      *coalescedBatch
+}
+
+// coalescedBatch is the batch currently collecting requests.
+type coalescedBatch struct {
+	buf   bytes.Buffer
+	offs  []runOffsets
+	ids   map[uuid.UUID]struct{}
+	timer *time.Timer
+	reqs  []*coalescedRequest
+
+	done chan struct{}
+}
+
+// coalescedRequest is one request's share of a batch and, once the batch is done, its
+// result.
+type coalescedRequest struct {
+	frag []byte
+	offs []runOffsets
+
+	existing []string
+	err      error
+}
+
+func newCoalescer(srv *Server, window time.Duration, maxRuns, maxBytes int) *coalescer {
+	return &coalescer{srv: srv, write: srv.writeBatch, window: window, maxRuns: maxRuns, maxBytes: maxBytes}
+}
+
+// accepts reports whether a serialized request of this size should be coalesced.
+// Requests that would fill a batch on their own are written directly.
+func (c *coalescer) accepts(size, runs int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.window > 0 && size < c.maxBytes && runs < c.maxRuns
+}
+
+// setLimits changes the window and batch limits. The batch currently collecting
+// requests is sent right away so that it never outlives the new limits.
+func (c *coalescer) setLimits(window time.Duration, maxRuns, maxBytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window, c.maxRuns, c.maxBytes = window, maxRuns, maxBytes
+	if c.cur != nil {
+		c.detachLocked(c.cur)
+	}
+}
+
+// submit adds a request's serialized runs (a JSON array produced by buildBatch) to the
+// current batch and waits for that batch to be written. It returns the IDs of this
+// request's runs that already existed.
+func (c *coalescer) submit(frag []byte, offs []runOffsets) ([]string, error) {
+	c.mu.Lock()
+	b := c.cur
+	if b != nil && (b.conflicts(offs) || b.buf.Len()+len(frag) > c.maxBytes || len(b.offs)+len(offs) > c.maxRuns) {
+		// With the same id twice in one batch, only one request's run would be stored and
+		// neither would be told; oversized batches defeat the purpose. Send what we have
+		// and start over.
+		c.detachLocked(b)
+		b = nil
+	}
+	if b == nil {
+		b = &coalescedBatch{ids: make(map[uuid.UUID]struct{}), done: make(chan struct{})}
+		b.buf.WriteByte('[')
+		c.cur = b
+		b.timer = time.AfterFunc(c.window, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.cur == b {
+				c.detachLocked(b)
+			}
+		})
+	}
+	req := &coalescedRequest{frag: frag, offs: offs}
+	b.reqs = append(b.reqs, req)
+	b.add(frag, offs)
+	if b.buf.Len() >= c.maxBytes || len(b.offs) >= c.maxRuns {
+		c.detachLocked(b)
+	}
+	c.mu.Unlock()
+
+	<-b.done
+	return req.existing, req.err
+}
+
+// flush writes the batch that is currently collecting requests, if any.
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cur != nil {
+		c.detachLocked(c.cur)
+	}
+}
+
+// detachLocked stops b from accepting requests and writes it in the background. The
+// write is registered with the server here, before the goroutine starts, so that a
+// concurrent drain cannot miss it.
+func (c *coalescer) detachLocked(b *coalescedBatch) {
+	b.timer.Stop()
+	if c.cur == b {
+		c.cur = nil
+	}
+	if !c.srv.beginWrite() {
+		for _, req := range b.reqs {
+			req.err = errShuttingDown
+		}
+		close(b.done)
+		return
+	}
+	go c.send(b)
+}
+
+// send writes the batch and hands each request its result. If the shared write fails,
+// each request is written again on its own, so that one request's bad runs do not fail
+// the others.
+func (c *coalescer) send(b *coalescedBatch) {
+	defer c.srv.writes.Done()
+	defer close(b.done)
+	b.buf.WriteByte(']')
+	// The batch is shared by several requests, so it must not be cancelled by any one of
+	// them; only an aborted shutdown stops it.
+	ctx := c.srv.abortWrites
+	existing, err := c.write(ctx, newBatchKey(), b.buf.Bytes(), b.offs)
+	if err == nil {
+		found := make(map[string]struct{}, len(existing))
+		for _, id := range existing {
+			found[id] = struct{}{}
+		}
+		for _, req := range b.reqs {
+			for _, ro := range req.offs {
+				if _, ok := found[ro.id.String()]; ok {
+					req.existing = append(req.existing, ro.id.String())
+				}
+			}
+		}
+		return
+	}
+	if len(b.reqs) == 1 || ctx.Err() != nil {
+		for _, req := range b.reqs {
+			req.err = err
+		}
+		return
+	}
+	slog.Warn("coalesced batch write failed; writing its requests separately", "requests", len(b.reqs), "runs", len(b.offs), "error", err)
+	var wg sync.WaitGroup
+	for _, req := range b.reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req.existing, req.err = c.write(ctx, newBatchKey(), req.frag, req.offs)
+		}()
+	}
+	wg.Wait()
+}
+
+func newBatchKey() string {
+	return fmt.Sprintf("batches/%s.json", uuid.New().String())
+}
+
+// conflicts reports whether any of offs is already part of the batch.
+func (b *coalescedBatch) conflicts(offs []runOffsets) bool {
+	for _, ro := range offs {
+		if _, ok := b.ids[ro.id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// add appends the elements of the JSON array frag to the batch, shifting the byte
+// ranges in offs to their position in the combined object.
+func (b *coalescedBatch) add(frag []byte, offs []runOffsets) {
+	if len(b.offs) > 0 {
+		b.buf.WriteByte(',')
+	}
+	// frag is "[...]": its content starts at index 1 and lands at the current length.
+	shift := b.buf.Len() - 1
+	b.buf.Write(frag[1 : len(frag)-1])
+	for _, ro := range offs {
+		ro.inputs = ro.inputs.shift(shift)
+		ro.outputs = ro.outputs.shift(shift)
+		ro.metadata = ro.metadata.shift(shift)
+		b.offs = append(b.offs, ro)
+		b.ids[ro.id] = struct{}{}
+	}
+}
+
+// shift moves the range by n bytes.
+func (br byteRange) shift(n int) byteRange {
+	return byteRange{start: br.start + n, end: br.end + n}
+}
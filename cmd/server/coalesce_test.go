@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestCoalescedBatchOffsets(t *testing.T) {
+	reqs := [][]runJSON{
+		{
+			{TraceID: uuid.New().String(), Name: "a", Inputs: json.RawMessage(`{"q":"first"}`)},
+			{TraceID: uuid.New().String(), Name: "b", Outputs: json.RawMessage(`{"r":[1,2,3]}`)},
+		},
+		{
+			{TraceID: uuid.New().String(), Name: "c", Metadata: json.RawMessage(`{"model":"gpt-4"}`)},
+		},
+	}
+
+	b := &coalescedBatch{ids: make(map[uuid.UUID]struct{})}
+	b.buf.WriteByte('[')
+	var want [][3]string
+	for _, runs := range reqs {
+		var frag bytes.Buffer
+		offs, err := buildBatch(&frag, runs, "", indexer{})
+		if err != nil {
+			t.Fatalf("buildBatch: %v", err)
+		}
+		for _, ro := range offs {
+			body := frag.Bytes()
+			want = append(want, [3]string{
+				string(body[ro.inputs.start:ro.inputs.end]),
+				string(body[ro.outputs.start:ro.outputs.end]),
+				string(body[ro.metadata.start:ro.metadata.end]),
+			})
+		}
+		b.add(frag.Bytes(), offs)
+	}
+	b.buf.WriteByte(']')
+
+	var decoded []map[string]any
+	if err := json.Unmarshal(b.buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("combined batch is not valid JSON: %v\n%s", err, b.buf.Bytes())
+	}
+	if len(decoded) != 3 || len(b.offs) != 3 {
+		t.Fatalf("expected 3 runs, got %d decoded and %d offsets", len(decoded), len(b.offs))
+	}
+	body := b.buf.Bytes()
+	for i, ro := range b.offs {
+		got := [3]string{
+			string(body[ro.inputs.start:ro.inputs.end]),
+			string(body[ro.outputs.start:ro.outputs.end]),
+			string(body[ro.metadata.start:ro.metadata.end]),
+		}
+		if got != want[i] {
+			t.Fatalf("run %d: want fields %q, got %q", i, want[i], got)
+		}
+	}
+	if !b.conflicts(b.offs[:1]) {
+		t.Fatalf("expected batch to report a conflict for an id it already holds")
+	}
+}
+
+func TestCoalescerRetriesRequestsSeparately(t *testing.T) {
+	srv := newServer(appconfig.Defaults(), nil, nil)
+	c := newCoalescer(srv, time.Hour, 100, 1<<20)
+	var mu sync.Mutex
+	writes := 0
+	c.write = func(_ context.Context, _ string, body []byte, offs []runOffsets) ([]string, error) {
+		mu.Lock()
+		writes++
+		mu.Unlock()
+		if bytes.Contains(body, []byte(`"bad"`)) {
+			return nil, errors.New("rejected")
+		}
+		return []string{offs[0].id.String()}, nil
+	}
+
+	results := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, name := range []string{"good", "bad"} {
+		var frag bytes.Buffer
+		offs, err := buildBatch(&frag, []runJSON{{TraceID: uuid.NewString(), Name: name}}, "", indexer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.submit(frag.Bytes(), offs)
+			mu.Lock()
+			results[name] = err
+			mu.Unlock()
+		}()
+	}
+	// Both requests must have joined the batch before it is sent.
+	for {
+		c.mu.Lock()
+		n := 0
+		if c.cur != nil {
+			n = len(c.cur.reqs)
+		}
+		c.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.flush()
+	wg.Wait()
+
+	if results["good"] != nil || results["bad"] == nil {
+		t.Errorf("want only the bad request to fail, got %v", results)
+	}
+	if writes != 3 {
+		t.Errorf("write called %d times, want the shared write and one per request", writes)
+	}
+}
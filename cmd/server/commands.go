@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+// runCommand dispatches the subcommands that can be run instead of the server.
+func runCommand(ctx context.Context, settings appconfig.Settings, s3Client *s3.Client, db *pgxpool.Pool, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrateCommand(ctx, db, args[1:])
+	case "config":
+		return runConfigCommand(settings, args[1:])
+	case "search":
+		return runSearchCommand(ctx, settings, s3Client, db, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// runConfigCommand implements "config print", which writes the effective settings as
+// YAML with secrets redacted.
+func runConfigCommand(settings appconfig.Settings, args []string) error {
+	if len(args) != 1 || args[0] != "print" {
+		return fmt.Errorf("usage: config print")
+	}
+	out, err := settings.RedactedYAML()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Run fields are stored in S3 as plain JSON, so there are never compressed bytes to pass
+// through: responses are compressed on the fly while they stream, and compressed
+// request bodies are decompressed while they are parsed.
+
+var gzipWriterPool = sync.Pool{New: func() any {
+	zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return zw
+}}
+
+var zstdWriterPool = sync.Pool{New: func() any {
+	// One goroutine per encoder: responses are compressed concurrently already.
+	zw, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+	return zw
+}}
+
+// negotiateEncoding picks the response content coding from an Accept-Encoding header:
+// zstd or gzip, whichever the client weights higher (zstd on a tie), or "" for identity.
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				weight = f
+			}
+		}
+		q[name] = weight
+	}
+	weight := func(coding string) float64 {
+		if w, ok := q[coding]; ok {
+			return w
+		}
+		return q["*"]
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"zstd", "gzip"} {
+		if w := weight(coding); w > bestQ {
+			best, bestQ = coding, w
+		}
+	}
+	return best
+}
+
+// compressResponse compresses response bodies with the coding negotiated from
+// Accept-Encoding. Bodies shorter than the configured minimum are sent as they are.
+func (s *Server) compressResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.settings()
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if !cfg.HTTPCompression || encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: cfg.HTTPCompressionMinBytes, ifNoneMatch: r.Header.Get("If-None-Match")}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds back the status line and the first minSize bytes of the body to
+// decide whether compressing is worthwhile, then streams through an encoder. A body it
+// encodes gets the coding appended to its ETag, so each coding has its own validator.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	minSize     int
+	ifNoneMatch string // the request's If-None-Match, to answer a 304 in the client's terms
+
+	status      int  // status passed to WriteHeader, sent once the decision is made
+	headerSent  bool // status line written to the underlying writer
+	passthrough bool // body goes out unmodified
+	pending     []byte
+	enc         io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+	// Bodiless and already-encoded responses are never touched.
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified || cw.Header().Get("Content-Encoding") != "" {
+		if etag := cw.Header().Get("ETag"); code == http.StatusNotModified && etag != "" {
+			// The client holds either the identity or an encoded representation; a 304
+			// names the one it matched.
+			if tag := matchedETag(cw.ifNoneMatch, etag); tag != "" && tag != "*" {
+				cw.Header().Set("ETag", tag)
+			}
+		}
+		cw.passthrough = true
+		cw.sendHeader()
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.passthrough:
+		return cw.ResponseWriter.Write(p)
+	case cw.enc != nil:
+		return cw.enc.Write(p)
+	}
+	cw.pending = append(cw.pending, p...)
+	if len(cw.pending) >= cw.minSize {
+		if err := cw.startEncoding(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends everything written so far, compressing it if the decision is still open.
+func (cw *compressWriter) Flush() {
+	if cw.status != 0 && !cw.passthrough && cw.enc == nil {
+		_ = cw.startEncoding()
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+func (cw *compressWriter) sendHeader() {
+	if !cw.headerSent {
+		cw.headerSent = true
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+}
+
+func (cw *compressWriter) startEncoding() error {
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", codedETag(etag, cw.encoding))
+	}
+	h.Del("Content-Length")
+	cw.sendHeader()
+	switch cw.encoding {
+	case "zstd":
+		zw := zstdWriterPool.Get().(*zstd.Encoder)
+		zw.Reset(cw.ResponseWriter)
+		cw.enc = zw
+	default:
+		zw := gzipWriterPool.Get().(*gzip.Writer)
+		zw.Reset(cw.ResponseWriter)
+		cw.enc = zw
+	}
+	pending := cw.pending
+	cw.pending = nil
+	_, err := cw.enc.Write(pending)
+	return err
+}
+
+// close finishes the response: short bodies go out uncompressed, encoders are flushed
+// and returned to their pools.
+func (cw *compressWriter) close() {
+	if cw.status == 0 {
+		return
+	}
+	if cw.enc == nil {
+		if !cw.passthrough {
+			cw.Header().Set("Content-Length", strconv.Itoa(len(cw.pending)))
+			cw.sendHeader()
+			_, _ = cw.ResponseWriter.Write(cw.pending)
+		}
+		return
+	}
+	_ = cw.enc.Close()
+	switch zw := cw.enc.(type) {
+	case *zstd.Encoder:
+		zstdWriterPool.Put(zw)
+	case *gzip.Writer:
+		gzipWriterPool.Put(zw)
+	}
+}
+
+// errUnsupportedEncoding is returned for request bodies in a coding we cannot decode.
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// errBodyTooLarge reports a decompressed request body over the configured limit.
+type errBodyTooLarge struct{ limit int64 }
+
+func (e errBodyTooLarge) Error() string {
+	return fmt.Sprintf("decompressed request body exceeds %d bytes", e.limit)
+}
+
+var zstdReaderPool sync.Pool
+
+// requestBody is a request body with its Content-Encoding removed. It enforces the
+// wire-size and decompressed-size limits and remembers the first read error, so that a
+// failure of the body itself can be told apart from invalid JSON.
+type requestBody struct {
+	encoding string
+	wire     countingReader
+	r        io.Reader
+	read     int64
+	limit    int64
+	err      error
+	release  func()
+}
+
+// openRequestBody wraps r.Body according to its Content-Encoding (identity, gzip or
+// zstd). maxWire bounds the bytes read from the client, maxDecoded the bytes produced by
+// decompression.
+func openRequestBody(w http.ResponseWriter, r *http.Request, maxWire, maxDecoded int64) (*requestBody, error) {
+	b := &requestBody{encoding: strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))), limit: maxDecoded}
+	b.wire.r = http.MaxBytesReader(w, r.Body, maxWire)
+	switch b.encoding {
+	case "", "identity":
+		b.encoding = ""
+		b.r = &b.wire
+	case "gzip", "x-gzip":
+		b.encoding = "gzip"
+		zr, err := gzip.NewReader(&b.wire)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		b.r = zr
+	case "zstd":
+		zr, _ := zstdReaderPool.Get().(*zstd.Decoder)
+		if zr == nil {
+			var err error
+			// The window bound keeps a hostile frame header from reserving huge buffers.
+			zr, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(64<<20))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := zr.Reset(&b.wire); err != nil {
+			zstdReaderPool.Put(zr)
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		b.r = zr
+		b.release = func() {
+			_ = zr.Reset(nil)
+			zstdReaderPool.Put(zr)
+		}
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	return b, nil
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.encoding != "" && int64(len(p)) > b.limit-b.read+1 {
+		p = p[:b.limit-b.read+1]
+	}
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.encoding != "" && b.read > b.limit {
+		b.err = errBodyTooLarge{limit: b.limit}
+		return n, b.err
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// close releases the decoder and records the compression ratio of the body.
+func (b *requestBody) close() {
+	if b.release != nil {
+		b.release()
+	}
+	if b.encoding != "" && b.wire.n > 0 && b.err == nil {
+		requestCompressionRatio.WithLabelValues(b.encoding).Observe(float64(b.read) / float64(b.wire.n))
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip":                    "gzip",
+		"gzip, deflate, br, zstd": "zstd",
+		"zstd;q=0.5, gzip":        "gzip",
+		"gzip;q=0, zstd;q=0":      "",
+		"*":                       "zstd",
+		"*;q=0.1, gzip;q=0.8":     "gzip",
+		"GZIP; q=0.9":             "gzip",
+	}
+	for accept, want := range cases {
+		if got := negotiateEncoding(accept); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	srv := newServer(appconfig.Defaults(), nil, nil)
+	large := strings.Repeat(`{"key":"value"},`, 1000)
+	const etag = `"abc"`
+	handler := srv.compressResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		switch r.URL.Path {
+		case "/large":
+			w.WriteHeader(http.StatusCreated)
+			// Several writes, as getRunHandler streams field by field.
+			for i := 0; i < len(large); i += 1000 {
+				_, _ = io.WriteString(w, large[i:min(i+1000, len(large))])
+			}
+		case "/small":
+			_, _ = io.WriteString(w, `{"error":"not found"}`)
+		case "/not-modified":
+			w.WriteHeader(http.StatusNotModified)
+		}
+	}))
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		t.Run(encoding, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/large", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != encoding {
+				t.Fatalf("Content-Encoding = %q", got)
+			}
+			if got, want := rec.Header().Get("ETag"), `"abc-`+encoding+`"`; got != want {
+				t.Errorf("ETag = %q, want %q", got, want)
+			}
+			if rec.Body.Len() >= len(large) {
+				t.Errorf("compressed body is %d bytes, original %d", rec.Body.Len(), len(large))
+			}
+			zr, err := decode(bytes.NewReader(rec.Body.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != large {
+				t.Fatal("decompressed body differs")
+			}
+		})
+	}
+
+	for _, path := range []string{"/small", "/not-modified"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: Content-Encoding = %q, want none", path, got)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s: Vary = %q", path, got)
+		}
+		if got := rec.Header().Get("ETag"); got != etag {
+			t.Errorf("%s: ETag = %q, want %q", path, got, etag)
+		}
+	}
+
+	// A 304 names the representation the client revalidated.
+	req := httptest.NewRequest(http.MethodGet, "/not-modified", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", `W/"abc-gzip"`)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("ETag"); got != `"abc-gzip"` {
+		t.Errorf("304 ETag = %q, want the gzip tag", got)
+	}
+}
+
+func TestOpenRequestBody(t *testing.T) {
+	payload := []byte(`[` + strings.Repeat(`{"name":"run","inputs":{"text":"hello"}},`, 200) + `{}]`)
+	compress := map[string]func([]byte) []byte{
+		"": func(b []byte) []byte { return b },
+		"gzip": func(b []byte) []byte {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			_, _ = zw.Write(b)
+			_ = zw.Close()
+			return buf.Bytes()
+		},
+		"zstd": func(b []byte) []byte {
+			zw, _ := zstd.NewWriter(nil)
+			defer zw.Close()
+			return zw.EncodeAll(b, nil)
+		},
+	}
+	open := func(encoding string, body []byte, maxWire, maxDecoded int64) (*requestBody, []byte, error) {
+		req := httptest.NewRequest(http.MethodPost, "/runs", bytes.NewReader(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		b, err := openRequestBody(httptest.NewRecorder(), req, maxWire, maxDecoded)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer b.close()
+		out, err := io.ReadAll(b)
+		return b, out, err
+	}
+
+	for encoding, enc := range compress {
+		t.Run("roundtrip "+encoding, func(t *testing.T) {
+			b, out, err := open(encoding, enc(payload), 1<<20, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, payload) {
+				t.Fatal("body differs after decoding")
+			}
+			if b.read != int64(len(payload)) {
+				t.Errorf("read %d bytes, want %d", b.read, len(payload))
+			}
+		})
+	}
+
+	t.Run("decompression bomb", func(t *testing.T) {
+		for _, encoding := range []string{"gzip", "zstd"} {
+			bomb := compress[encoding](make([]byte, 4<<20))
+			_, _, err := open(encoding, bomb, 1<<20, 1<<20)
+			var tooLarge errBodyTooLarge
+			if !errors.As(err, &tooLarge) {
+				t.Errorf("%s: err = %v, want errBodyTooLarge", encoding, err)
+			}
+		}
+	})
+
+	t.Run("wire limit", func(t *testing.T) {
+		_, _, err := open("", payload, 100, 1<<20)
+		var tooLarge *http.MaxBytesError
+		if !errors.As(err, &tooLarge) {
+			t.Errorf("err = %v, want *http.MaxBytesError", err)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		if _, _, err := open("br", payload, 1<<20, 1<<20); !errors.Is(err, errUnsupportedEncoding) {
+			t.Errorf("err = %v, want errUnsupportedEncoding", err)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+// databaseURL builds the Postgres connection URL for settings, escaping the credentials.
+func databaseURL(settings appconfig.Settings) string {
+	user := url.User(settings.DBUser)
+	if settings.DBPassword != "" {
+		user = url.UserPassword(settings.DBUser, settings.DBPassword)
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     user,
+		Host:     net.JoinHostPort(settings.DBHost, settings.DBPort),
+		Path:     "/" + settings.DBName,
+		RawQuery: url.Values{"sslmode": {settings.DBSSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// newPoolConfig returns the pgxpool configuration for settings: pool size, connect
+// timeout, TLS mode and a server-side statement timeout on every connection. With
+// DBPasswordFile, the password is read from the file for each new connection.
+func newPoolConfig(settings appconfig.Settings) (*pgxpool.Config, error) {
+	cfg, err := pgxpool.ParseConfig(databaseURL(settings))
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxConns = int32(settings.DBMaxConns)
+	cfg.MinConns = int32(settings.DBMinConns)
+	cfg.ConnConfig.ConnectTimeout = settings.DBConnectTimeout
+	if settings.DBStatementTimeout > 0 {
+		cfg.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(settings.DBStatementTimeout.Milliseconds(), 10)
+	}
+	if path := settings.DBPasswordFile; path != "" {
+		cfg.BeforeConnect = func(ctx context.Context, cc *pgx.ConnConfig) error {
+			pw, err := readSecretFile(path)
+			if err != nil {
+				return err
+			}
+			cc.Password = pw
+			return nil
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestNewPoolConfig(t *testing.T) {
+	settings := appconfig.Defaults()
+	settings.DBPassword = "p@ss:w/rd"
+	settings.DBSSLMode = "require"
+	settings.DBMaxConns = 8
+	settings.DBMinConns = 2
+	settings.DBConnectTimeout = 3 * time.Second
+	settings.DBStatementTimeout = 1500 * time.Millisecond
+
+	cfg, err := newPoolConfig(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ConnConfig.Password != settings.DBPassword {
+		t.Errorf("password = %q, want %q", cfg.ConnConfig.Password, settings.DBPassword)
+	}
+	if cfg.ConnConfig.TLSConfig == nil {
+		t.Error("sslmode=require should configure TLS")
+	}
+	if cfg.MaxConns != 8 || cfg.MinConns != 2 {
+		t.Errorf("pool size = %d..%d, want 2..8", cfg.MinConns, cfg.MaxConns)
+	}
+	if cfg.ConnConfig.ConnectTimeout != 3*time.Second {
+		t.Errorf("connect timeout = %s", cfg.ConnConfig.ConnectTimeout)
+	}
+	if got := cfg.ConnConfig.RuntimeParams["statement_timeout"]; got != "1500" {
+		t.Errorf("statement_timeout = %q, want 1500", got)
+	}
+}
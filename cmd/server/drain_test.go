@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestDrainWaitsForWrites(t *testing.T) {
+	srv := newServer(appconfig.Defaults(), nil, nil)
+	if !srv.beginWrite() {
+		t.Fatal("beginWrite refused before drain")
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.drain(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("drain returned with a write in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if srv.beginWrite() {
+		t.Error("beginWrite accepted a write while draining")
+	}
+	srv.writes.Done()
+	if err := <-done; err != nil {
+		t.Errorf("drain: %v", err)
+	}
+}
+
+func TestDrainTimeoutAbortsWrites(t *testing.T) {
+	srv := newServer(appconfig.Defaults(), nil, nil)
+	if !srv.beginWrite() {
+		t.Fatal("beginWrite refused before drain")
+	}
+	// The write finishes only once it is told to roll back.
+	go func() {
+		<-srv.abortWrites.Done()
+		srv.writes.Done()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("drain = %v, want a deadline error", err)
+	}
+}
+
+func TestCoalescerRefusesAfterDrain(t *testing.T) {
+	srv := newServer(appconfig.Defaults(), nil, nil)
+	if err := srv.drain(context.Background()); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	// One run fills the batch, so it is detached, and refused, right away.
+	c := newCoalescer(srv, time.Hour, 1, 1<<20)
+	if _, err := c.submit([]byte(`[{}]`), []runOffsets{{id: uuid.New()}}); !errors.Is(err, errShuttingDown) {
+		t.Errorf("submit = %v, want errShuttingDown", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// runETag derives a strong ETag from everything that identifies a stored run's bytes:
+// its id, trace id, name, tags and the S3 refs of its fields. A stored run is never
+// rewritten, so only a change of tags changes the ETag.
+func runETag(id, traceID uuid.UUID, name string, tags []string, refs ...string) string {
+	h := sha256.New()
+	h.Write(id[:])
+	h.Write(traceID[:])
+	// Lengths keep the boundaries between variable-length parts unambiguous.
+	fmt.Fprintf(h, "%d:%s", len(name), name)
+	fmt.Fprintf(h, "%d:", len(tags))
+	for _, tag := range tags {
+		fmt.Fprintf(h, "%d:%s", len(tag), tag)
+	}
+	for _, ref := range refs {
+		fmt.Fprintf(h, "%d:%s", len(ref), ref)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// responseCodings are the content codings compressResponse may apply to a body.
+var responseCodings = []string{"zstd", "gzip"}
+
+// codedETag returns the ETag of the representation of etag sent in a content coding.
+// RFC 9110 requires strong validators to differ between codings, so the coding is
+// appended inside the quotes.
+func codedETag(etag, coding string) string {
+	if coding == "" || len(etag) < 2 || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + coding + `"`
+}
+
+// etagMatches implements the If-None-Match comparison: "*" or any listed tag matching
+// etag, ignoring weakness as RFC 9110 requires for this header.
+func etagMatches(ifNoneMatch, etag string) bool {
+	return matchedETag(ifNoneMatch, etag) != ""
+}
+
+// matchedETag returns the first tag of an If-None-Match list that matches etag, either
+// as it is or in one of the response codings, without any weak prefix; "" if none does.
+func matchedETag(ifNoneMatch, etag string) string {
+	if ifNoneMatch == "" {
+		return ""
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return tag
+		}
+		for _, coding := range responseCodings {
+			if tag == codedETag(etag, coding) {
+				return tag
+			}
+		}
+	}
+	return ""
+}
+
+// runCacheControl returns the Cache-Control value for a stored run. By default every
+// read revalidates, which is a cheap 304, because tags can change at any time. Setting
+// RunCacheMaxAge lets clients reuse runs with outputs, which are otherwise complete, at
+// the cost of showing stale tags for that long.
+func (s *Server) runCacheControl(outputsRef string) string {
+	maxAge := s.settings().RunCacheMaxAge
+	if maxAge <= 0 || !s.refHasContent(outputsRef) {
+		return "private, no-cache"
+	}
+	return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
+}
+
+// refHasContent reports whether ref points at a field value other than {} or null.
+func (s *Server) refHasContent(ref string) bool {
+	_, _, start, end, ok := s.parseS3Ref(ref)
+	return ok && end-start > len("null")
+}
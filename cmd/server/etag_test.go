@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestRunETag(t *testing.T) {
+	id, traceID := uuid.New(), uuid.New()
+	refs := []string{"s3://runs/batches/a.json#10:20/inputs", "s3://runs/batches/a.json#30:40/outputs", "s3://runs/batches/a.json#50:52/metadata"}
+	tags := []string{"prod"}
+	etag := runETag(id, traceID, "run", tags, refs...)
+	if etag != runETag(id, traceID, "run", tags, refs...) {
+		t.Fatal("ETag is not deterministic")
+	}
+	if len(etag) < 3 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		t.Fatalf("ETag %s is not a quoted strong tag", etag)
+	}
+	rewritten := append([]string{}, refs...)
+	rewritten[1] = "s3://runs/batches/b.json#30:40/outputs"
+	if runETag(id, traceID, "run", tags, rewritten...) == etag {
+		t.Error("ETag should change when a ref changes")
+	}
+	if runETag(id, traceID, "run2", tags, refs...) == etag {
+		t.Error("ETag should change when the name changes")
+	}
+	if runETag(id, traceID, "run", []string{"prod", "eval"}, refs...) == etag {
+		t.Error("ETag should change when the tags change")
+	}
+
+	for header, want := range map[string]bool{
+		"":                       false,
+		etag:                     true,
+		"W/" + etag:              true,
+		`"other", ` + etag:       true,
+		"*":                      true,
+		`"other"`:                false,
+		etag[:len(etag)-2] + `"`: false,
+		codedETag(etag, "gzip"):  true,
+		codedETag(etag, "zstd"):  true,
+		codedETag(etag, "br"):    false,
+	} {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestRunCacheControl(t *testing.T) {
+	// Tags can change, so by default even completed runs revalidate.
+	if got := newServer(appconfig.Defaults(), nil, nil).runCacheControl("s3://runs/batches/a.json#30:45/outputs"); got != "private, no-cache" {
+		t.Errorf("completed run with default settings: %q", got)
+	}
+
+	cfg := appconfig.Defaults()
+	cfg.RunCacheMaxAge = time.Minute
+	srv := newServer(cfg, nil, nil)
+
+	if got := srv.runCacheControl("s3://runs/batches/a.json#30:45/outputs"); got != "private, max-age=60" {
+		t.Errorf("completed run: %q", got)
+	}
+	for _, ref := range []string{"s3://runs/batches/a.json#30:32/outputs", "s3://runs/batches/a.json#30:34/outputs", ""} {
+		if got := srv.runCacheControl(ref); got != "private, no-cache" {
+			t.Errorf("run without outputs (%q): %q", ref, got)
+		}
+	}
+}
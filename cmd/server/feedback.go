@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxFeedbackBatch bounds the entries of one POST /feedback.
+	maxFeedbackBatch = 1000
+	// maxFeedbackBodyBytes bounds feedback request bodies.
+	maxFeedbackBodyBytes = 8 * 1024 * 1024
+	// maxFeedbackValueBytes bounds the JSON value of one entry.
+	maxFeedbackValueBytes = 64 * 1024
+	// maxFeedbackCommentBytes bounds the comment of one entry.
+	maxFeedbackCommentBytes = 16 * 1024
+	// maxFeedbackKeyLen bounds feedback keys and sources.
+	maxFeedbackKeyLen = 128
+	// maxFeedbackStatsRows bounds the groups returned by GET /feedback/stats.
+	maxFeedbackStatsRows = 10000
+
+	// pgForeignKeyViolation is the SQLSTATE for foreign_key_violation.
+	pgForeignKeyViolation = "23503"
+)
+
+// feedbackColumns are the columns written for every feedback entry, in COPY order.
+var feedbackColumns = []string{"id", "run_id", "key", "score", "value", "comment", "source", "created_at"}
+
+// feedbackIn is one feedback entry as sent by clients. RunID is only used by the batch
+// endpoint; the per-run endpoint takes it from the URL.
+type feedbackIn struct {
+	RunID   string          `json:"run_id"`
+	Key     string          `json:"key"`
+	Score   *float64        `json:"score"`
+	Value   json.RawMessage `json:"value"`
+	Comment *string         `json:"comment"`
+	Source  *string         `json:"source"`
+}
+
+// feedback is a stored feedback entry.
+type feedback struct {
+	ID        uuid.UUID       `json:"id"`
+	RunID     uuid.UUID       `json:"run_id"`
+	Key       string          `json:"key"`
+	Score     *float64        `json:"score"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Comment   *string         `json:"comment,omitempty"`
+	Source    *string         `json:"source,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// newFeedback validates in and turns it into an entry for runID.
+func newFeedback(runID uuid.UUID, in feedbackIn, now time.Time) (feedback, error) {
+	fb := feedback{ID: uuid.New(), RunID: runID, Key: strings.TrimSpace(in.Key), Score: in.Score, Comment: in.Comment, Source: in.Source, CreatedAt: now}
+	switch {
+	case fb.Key == "" || len(fb.Key) > maxFeedbackKeyLen:
+		return feedback{}, fmt.Errorf("key must be between 1 and %d bytes", maxFeedbackKeyLen)
+	case in.Score != nil && (math.IsNaN(*in.Score) || math.IsInf(*in.Score, 0)):
+		return feedback{}, errors.New("score must be a finite number")
+	case len(in.Value) > maxFeedbackValueBytes:
+		return feedback{}, fmt.Errorf("value must be at most %d bytes of JSON", maxFeedbackValueBytes)
+	case in.Comment != nil && len(*in.Comment) > maxFeedbackCommentBytes:
+		return feedback{}, fmt.Errorf("comment must be at most %d bytes", maxFeedbackCommentBytes)
+	case in.Source != nil && len(*in.Source) > maxFeedbackKeyLen:
+		return feedback{}, fmt.Errorf("source must be at most %d bytes", maxFeedbackKeyLen)
+	}
+	if string(in.Value) != "null" {
+		fb.Value = in.Value
+	}
+	return fb, nil
+}
+
+// insertFeedback stores entries with one COPY. The caller checks that the runs exist;
+// a foreign key violation means one disappeared in between and is reported as such.
+func (s *Server) insertFeedback(ctx context.Context, entries []feedback) error {
+	ctx, span := tracer.Start(ctx, "db.insertFeedback", trace.WithAttributes(attribute.Int("rows", len(entries))))
+	rows := make([][]any, 0, len(entries))
+	for _, fb := range entries {
+		var value []byte
+		if fb.Value != nil {
+			value = fb.Value
+		}
+		rows = append(rows, []any{fb.ID, fb.RunID, fb.Key, fb.Score, value, fb.Comment, fb.Source, fb.CreatedAt})
+	}
+	_, err := s.db.CopyFrom(ctx, pgx.Identifier{"feedback"}, feedbackColumns, pgx.CopyFromRows(rows))
+	endSpan(span, err)
+	return err
+}
+
+// missingRuns returns the ids among ids that are not stored runs.
+func (s *Server) missingRuns(ctx context.Context, ids []uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := s.db.Query(ctx, `SELECT id FROM runs WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[uuid.UUID]bool, len(ids))
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var missing []uuid.UUID
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+			found[id] = true // report each id once
+		}
+	}
+	return missing, nil
+}
+
+// runNotReady writes 409 if runID is still waiting in the async ingest queue, where
+// feedback cannot reference it yet.
+func (s *Server) runNotReady(w http.ResponseWriter, runID uuid.UUID) bool {
+	if s.queue == nil {
+		return false
+	}
+	if _, ok := s.queue.lookup(runID); !ok {
+		return false
+	}
+	w.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("run %s is still being ingested; retry shortly", runID)})
+	return true
+}
+
+// createFeedbackHandler implements POST /runs/{id}/feedback.
+func (s *Server) createFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	runID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "id must be a valid UUID"})
+		return
+	}
+	var in feedbackIn
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFeedbackBodyBytes)).Decode(&in); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	fb, err := newFeedback(runID, in, time.Now().UTC())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if s.runNotReady(w, runID) {
+		return
+	}
+	err = s.insertFeedback(ctx, []feedback{fb})
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr) && pgErr.Code == pgForeignKeyViolation:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Run with ID %s not found", runID)})
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to store feedback"})
+	default:
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(fb)
+	}
+}
+
+// createFeedbackBatchHandler implements POST /feedback, which stores an array of
+// entries for any runs at once. Either all entries are stored or none.
+func (s *Server) createFeedbackBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	var in []feedbackIn
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFeedbackBodyBytes)).Decode(&in); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "body must be a JSON array of feedback"})
+		return
+	}
+	if len(in) == 0 || len(in) > maxFeedbackBatch {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("send between 1 and %d feedback entries", maxFeedbackBatch)})
+		return
+	}
+	now := time.Now().UTC()
+	entries := make([]feedback, 0, len(in))
+	runIDs := make([]uuid.UUID, 0, len(in))
+	for i, fi := range in {
+		runID, err := uuid.Parse(fi.RunID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("invalid run_id at index %d", i)})
+			return
+		}
+		fb, err := newFeedback(runID, fi, now)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("invalid feedback at index %d: %v", i, err)})
+			return
+		}
+		if s.runNotReady(w, runID) {
+			return
+		}
+		entries = append(entries, fb)
+		runIDs = append(runIDs, runID)
+	}
+
+	missing, err := s.missingRuns(ctx, runIDs)
+	if err == nil && len(missing) > 0 {
+		ids := make([]string, 0, min(len(missing), 10))
+		for _, id := range missing[:min(len(missing), 10)] {
+			ids = append(ids, id.String())
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("%d runs not found: %s", len(missing), strings.Join(ids, ", "))})
+		return
+	}
+	if err == nil {
+		err = s.insertFeedback(ctx, entries)
+	}
+	// A run deleted since the check above still fails the COPY on its foreign key.
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr) && pgErr.Code == pgForeignKeyViolation:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "one or more runs not found"})
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to store feedback"})
+		return
+	}
+	ids := make([]string, 0, len(entries))
+	for _, fb := range entries {
+		ids = append(ids, fb.ID.String())
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string][]string{"feedback_ids": ids})
+}
+
+// listFeedbackHandler implements GET /runs/{id}/feedback, oldest first, optionally
+// restricted to one key.
+func (s *Server) listFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	runID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "id must be a valid UUID"})
+		return
+	}
+	f := &sqlBuilder{}
+	f.conds = append(f.conds, "run_id = "+f.arg(runID))
+	if key := r.URL.Query().Get("key"); key != "" {
+		f.conds = append(f.conds, "key = "+f.arg(key))
+	}
+	queryCtx, span := tracer.Start(ctx, "listFeedback.query")
+	rows, err := s.db.Query(queryCtx,
+		`SELECT id, run_id, key, score, value, comment, source, created_at FROM feedback
+		 WHERE `+f.where()+` ORDER BY created_at, id`, f.args...)
+	entries := []feedback{}
+	if err == nil {
+		for rows.Next() {
+			var (
+				fb    feedback
+				value []byte
+			)
+			if err = rows.Scan(&fb.ID, &fb.RunID, &fb.Key, &fb.Score, &value, &fb.Comment, &fb.Source, &fb.CreatedAt); err != nil {
+				break
+			}
+			fb.Value = value
+			entries = append(entries, fb)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to list feedback"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string][]feedback{"feedback": entries})
+}
+
+// deleteFeedbackHandler implements DELETE /runs/{id}/feedback/{feedback_id}.
+func (s *Server) deleteFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	runID, err1 := uuid.Parse(chi.URLParam(r, "id"))
+	feedbackID, err2 := uuid.Parse(chi.URLParam(r, "feedback_id"))
+	if err1 != nil || err2 != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "id and feedback_id must be valid UUIDs"})
+		return
+	}
+	tag, err := s.db.Exec(r.Context(), `DELETE FROM feedback WHERE id = $1 AND run_id = $2`, feedbackID, runID)
+	switch {
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete feedback"})
+	case tag.RowsAffected() == 0:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Feedback with ID %s not found", feedbackID)})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// feedbackStat is one group of GET /feedback/stats.
+type feedbackStat struct {
+	Key        string     `json:"key"`
+	RunName    *string    `json:"run_name,omitempty"`
+	Bucket     *time.Time `json:"bucket,omitempty"`
+	Count      int64      `json:"count"`
+	ScoreCount int64      `json:"score_count"`
+	AvgScore   *float64   `json:"avg_score"`
+	MinScore   *float64   `json:"min_score"`
+	MaxScore   *float64   `json:"max_score"`
+}
+
+// feedbackBuckets are the accepted time buckets, which are also date_trunc units.
+var feedbackBuckets = map[string]bool{"minute": true, "hour": true, "day": true, "week": true, "month": true}
+
+// feedbackStatsQuery builds the aggregate query of GET /feedback/stats from its
+// parameters:
+//
+//	key=k                   only this feedback key
+//	group_by=run_name       group by run name as well as key
+//	bucket=hour             also group by time bucket: minute, hour, day, week or month
+//	from=, to=              RFC 3339 bounds on created_at, inclusive and exclusive
+//	run_name=n              only feedback on runs with this name
+func feedbackStatsQuery(q url.Values) (string, []any, error) {
+	f := &sqlBuilder{}
+	join, runName := "", "NULL::text"
+	switch q.Get("group_by") {
+	case "", "key":
+	case "run_name":
+		join, runName = " JOIN runs r ON r.id = f.run_id", "r.name"
+	default:
+		return "", nil, errors.New("group_by must be key or run_name")
+	}
+	bucket := "NULL::timestamptz"
+	if b := q.Get("bucket"); b != "" {
+		if !feedbackBuckets[b] {
+			return "", nil, errors.New("bucket must be minute, hour, day, week or month")
+		}
+		bucket = "date_trunc('" + b + "', f.created_at)"
+	}
+	if key := q.Get("key"); key != "" {
+		f.conds = append(f.conds, "f.key = "+f.arg(key))
+	}
+	if name := q.Get("run_name"); name != "" {
+		join = " JOIN runs r ON r.id = f.run_id"
+		f.conds = append(f.conds, "r.name = "+f.arg(name))
+	}
+	for _, b := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		if v := q.Get(b.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s must be an RFC 3339 timestamp", b.param)
+			}
+			f.conds = append(f.conds, "f.created_at "+b.op+" "+f.arg(t))
+		}
+	}
+	sql := `SELECT f.key, ` + runName + ` AS run_name, ` + bucket + ` AS bucket,
+	        count(*), count(f.score), avg(f.score), min(f.score), max(f.score)
+	 FROM feedback f` + join + `
+	 WHERE ` + f.where() + `
+	 GROUP BY 1, 2, 3
+	 ORDER BY 1, 2, 3
+	 LIMIT ` + f.arg(maxFeedbackStatsRows+1)
+	return sql, f.args, nil
+}
+
+// feedbackStatsHandler implements GET /feedback/stats: counts and score aggregates per
+// feedback key, optionally per run name and per time bucket.
+func (s *Server) feedbackStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	sql, args, err := feedbackStatsQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	queryCtx, span := tracer.Start(ctx, "feedbackStats.query")
+	rows, err := s.db.Query(queryCtx, sql, args...)
+	stats := []feedbackStat{}
+	if err == nil {
+		for rows.Next() {
+			var st feedbackStat
+			if err = rows.Scan(&st.Key, &st.RunName, &st.Bucket, &st.Count, &st.ScoreCount, &st.AvgScore, &st.MinScore, &st.MaxScore); err != nil {
+				break
+			}
+			stats = append(stats, st)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to compute feedback stats"})
+		return
+	}
+	if len(stats) > maxFeedbackStatsRows {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("more than %d groups; narrow the time range or use a larger bucket", maxFeedbackStatsRows)})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string][]feedbackStat{"stats": stats})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+func TestNewFeedback(t *testing.T) {
+	runID := uuid.New()
+	now := time.Now().UTC()
+	score := 0.5
+	fb, err := newFeedback(runID, feedbackIn{Key: " correctness ", Score: &score, Value: json.RawMessage(`null`)}, now)
+	if err != nil {
+		t.Fatalf("newFeedback: %v", err)
+	}
+	if fb.Key != "correctness" || fb.RunID != runID || *fb.Score != 0.5 || fb.Value != nil || !fb.CreatedAt.Equal(now) {
+		t.Errorf("got %+v", fb)
+	}
+
+	inf := math.Inf(1)
+	long := strings.Repeat("x", maxFeedbackKeyLen+1)
+	comment := strings.Repeat("x", maxFeedbackCommentBytes+1)
+	for name, in := range map[string]feedbackIn{
+		"no key":       {Key: "  "},
+		"long key":     {Key: long},
+		"inf score":    {Key: "k", Score: &inf},
+		"long source":  {Key: "k", Source: &long},
+		"long comment": {Key: "k", Comment: &comment},
+		"large value":  {Key: "k", Value: json.RawMessage(`"` + strings.Repeat("x", maxFeedbackValueBytes) + `"`)},
+	} {
+		if _, err := newFeedback(runID, in, now); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestFeedbackStatsQuery(t *testing.T) {
+	q := url.Values{
+		"key":      {"correctness"},
+		"group_by": {"run_name"},
+		"bucket":   {"day"},
+		"from":     {"2024-01-01T00:00:00Z"},
+		"to":       {"2024-02-01T00:00:00Z"},
+	}
+	sql, args, err := feedbackStatsQuery(q)
+	if err != nil {
+		t.Fatalf("feedbackStatsQuery: %v", err)
+	}
+	for _, want := range []string{"JOIN runs r", "r.name AS run_name", "date_trunc('day', f.created_at)", "f.key = $1", "f.created_at >= $2", "f.created_at < $3", "LIMIT $4"} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("query lacks %q:\n%s", want, sql)
+		}
+	}
+	if len(args) != 4 || args[0] != "correctness" || args[3] != maxFeedbackStatsRows+1 {
+		t.Errorf("args = %v", args)
+	}
+
+	sql, args, err = feedbackStatsQuery(url.Values{})
+	if err != nil || strings.Contains(sql, "JOIN") || !strings.Contains(sql, "WHERE TRUE") || len(args) != 1 {
+		t.Errorf("no params: %v, %v\n%s", args, err, sql)
+	}
+
+	for _, bad := range []url.Values{
+		{"bucket": {"second'; DROP TABLE runs; --"}},
+		{"group_by": {"source"}},
+		{"from": {"yesterday"}},
+	} {
+		if _, _, err := feedbackStatsQuery(bad); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// runFields are the stored fields of a run, which are also their column names.
+var runFields = []string{"inputs", "outputs", "metadata"}
+
+// getRunFieldHandler streams one field of a run as raw JSON. It honours a single-range
+// Range header, translated into an offset within the field's stored byte range, so
+// that clients can page through very large fields.
+func (s *Server) getRunFieldHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	idStr := chi.URLParam(r, "id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "id must be a valid UUID"})
+		return
+	}
+	field := chi.URLParam(r, "field")
+	if !slices.Contains(runFields, field) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("unknown field %q: must be inputs, outputs or metadata", field)})
+		return
+	}
+
+	if s.queue != nil {
+		if pr, ok := s.queue.lookup(id); ok {
+			br := map[string]byteRange{"inputs": pr.offs.inputs, "outputs": pr.offs.outputs, "metadata": pr.offs.metadata}[field]
+			w.Header().Set("Cache-Control", "no-store")
+			serveField(w, r, id, field, pr.batch.body[br.start:br.end], nil)
+			return
+		}
+	}
+
+	queryCtx, querySpan := tracer.Start(ctx, "getRunField.query", trace.WithAttributes(attribute.String("field", field)))
+	var (
+		outID      uuid.UUID
+		traceID    uuid.UUID
+		name       string
+		ref        string
+		outputsRef string
+	)
+	// field is one of runFields, so it is safe to use as a column name.
+	err = s.db.QueryRow(queryCtx,
+		`SELECT id, trace_id, name, COALESCE(`+field+`, ''), COALESCE(outputs, '')
+		 FROM runs WHERE id = $1`, id,
+	).Scan(&outID, &traceID, &name, &ref, &outputsRef)
+	endSpan(querySpan, err)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Run with ID %s not found", idStr)})
+		return
+	}
+
+	// The ref names the field, so this differs from the ETag of the whole run. Tags are
+	// not part of a field's bytes.
+	etag := runETag(outID, traceID, name, nil, ref)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", s.runCacheControl(outputsRef))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	bucket, key, start, end, ok := s.parseS3Ref(ref)
+	if !ok || bucket == "" || key == "" || end <= start {
+		serveField(w, r, outID, field, []byte(`{}`), nil)
+		return
+	}
+	serveField(w, r, outID, field, nil, &storedField{s: s, bucket: bucket, key: key, start: start, end: end})
+}
+
+// storedField locates a field's bytes in a batch object.
+type storedField struct {
+	s          *Server
+	bucket     string
+	key        string
+	start, end int
+}
+
+// serveField writes the field, either inline bytes or a stored field, answering a Range
+// header with 206 or 416. If-Range with anything but the current ETag sends it whole.
+func serveField(w http.ResponseWriter, r *http.Request, id uuid.UUID, field string, inline []byte, stored *storedField) {
+	size := len(inline)
+	if stored != nil {
+		size = stored.end - stored.start
+	}
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	rangeHeader := r.Header.Get("Range")
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != h.Get("ETag") {
+		rangeHeader = ""
+	}
+	start, end, partial, err := parseRange(rangeHeader, size)
+	if err != nil {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("range not satisfiable: field is %d bytes", size)})
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(end-start))
+	if partial {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if stored == nil {
+		_, _ = w.Write(inline[start:end])
+		return
+	}
+
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "getRunField.write", trace.WithAttributes(attribute.String("field", field)))
+	body, errCh := stored.s.openS3Range(ctx, stored.bucket, stored.key, stored.start+start, stored.start+end)
+	bufPtr := copyBufPool.Get().(*[]byte)
+	n, copyErr := io.CopyBuffer(w, body, *bufPtr)
+	copyBufPool.Put(bufPtr)
+	closeErr := body.Close()
+	fetchErr := <-errCh
+	span.SetAttributes(attribute.Int64("bytes", n))
+	endSpan(span, errors.Join(copyErr, closeErr, fetchErr))
+	if copyErr != nil || fetchErr != nil {
+		// The status line is out; stopping short of Content-Length makes the client
+		// see a truncated response rather than wrong bytes.
+		slog.ErrorContext(ctx, "stream field failed",
+			"run_id", id.String(),
+			"field", field,
+			"batch_key", stored.key,
+			"range_start", stored.start+start,
+			"range_end", stored.start+end,
+			"copy_error", copyErr,
+			"fetch_error", fetchErr,
+		)
+	}
+}
+
+// errRangeNotSatisfiable reports a Range header that selects no bytes of the body.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseRange interprets a Range header for a body of size bytes and returns the
+// half-open range to send. partial is false when the whole body should be sent: no
+// header, another unit, several ranges or a malformed spec, all of which RFC 9110 lets a
+// server ignore.
+func parseRange(header string, size int) (start, end int, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, false, nil
+	}
+	if first == "" {
+		// A suffix range: the last n bytes.
+		n, ok := parseDigits(last)
+		if !ok {
+			return 0, size, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		return max(size-n, 0), size, true, nil
+	}
+	start, ok = parseDigits(first)
+	if !ok {
+		return 0, size, false, nil
+	}
+	end = size
+	if last != "" {
+		l, ok := parseDigits(last)
+		if !ok || l < start {
+			return 0, size, false, nil
+		}
+		// Clamp before adding one: l may be as large as math.MaxInt.
+		end = min(l, size-1) + 1
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end, true, nil
+}
+
+// parseDigits parses a non-empty run of ASCII digits.
+func parseDigits(s string) (int, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 100
+	cases := []struct {
+		header     string
+		start, end int
+		partial    bool
+		err        bool
+	}{
+		{"", 0, 100, false, false},
+		{"bytes=0-9", 0, 10, true, false},
+		{"bytes=90-", 90, 100, true, false},
+		{"bytes=90-500", 90, 100, true, false},
+		{"bytes=0-9223372036854775807", 0, 100, true, false},
+		{"bytes=-10", 90, 100, true, false},
+		{"bytes=-500", 0, 100, true, false},
+		{"bytes=100-", 0, 0, false, true},
+		{"bytes=-0", 0, 0, false, true},
+		{"bytes=10-5", 0, 100, false, false},
+		{"bytes=0-1,5-6", 0, 100, false, false},
+		{"items=0-9", 0, 100, false, false},
+		{"bytes=+1-5", 0, 100, false, false},
+		{"bytes=abc", 0, 100, false, false},
+	}
+	for _, tc := range cases {
+		start, end, partial, err := parseRange(tc.header, size)
+		if start != tc.start || end != tc.end || partial != tc.partial || (err != nil) != tc.err {
+			t.Errorf("parseRange(%q) = %d, %d, %v, %v; want %d, %d, %v, error %v",
+				tc.header, start, end, partial, err, tc.start, tc.end, tc.partial, tc.err)
+		}
+	}
+}
+
+func TestServeFieldRanges(t *testing.T) {
+	body := []byte(`{"text":"hello world"}`)
+	const etag = `"abc"`
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/runs/x/fields/outputs", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		rec.Header().Set("ETag", etag)
+		serveField(rec, req, uuid.Nil, "outputs", body, nil)
+		return rec
+	}
+
+	rec := serve(nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != string(body) || rec.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("full: %d %q", rec.Code, rec.Body)
+	}
+
+	rec = serve(map[string]string{"Range": "bytes=9-13"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "hello" {
+		t.Fatalf("range: %d %q", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 9-13/22" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "5" {
+		t.Errorf("Content-Length = %q", got)
+	}
+
+	rec = serve(map[string]string{"Range": "bytes=22-"})
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */22" {
+		t.Fatalf("unsatisfiable: %d %q", rec.Code, rec.Header().Get("Content-Range"))
+	}
+
+	rec = serve(map[string]string{"Range": "bytes=9-13", "If-Range": etag})
+	if rec.Code != http.StatusPartialContent {
+		t.Errorf("matching If-Range: got %d, want 206", rec.Code)
+	}
+	rec = serve(map[string]string{"Range": "bytes=9-13", "If-Range": `"stale"`})
+	if rec.Code != http.StatusOK || rec.Body.Len() != len(body) {
+		t.Errorf("stale If-Range: got %d with %d bytes, want the whole field", rec.Code, rec.Body.Len())
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// idempotencyHeader lets clients safely retry a POST /runs batch.
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLen bounds the header value we are willing to hash.
+const maxIdempotencyKeyLen = 255
+
+// pgUniqueViolation is the SQLSTATE for unique_violation.
+const pgUniqueViolation = "23505"
+
+// idempotencyNamespace seeds deterministic run IDs derived from an Idempotency-Key.
+var idempotencyNamespace = uuid.MustParse("6f0b7d4e-2c1a-4f43-9a57-3f1f4c6b8e21")
+
+// runColumns are the columns written for every ingested run, in COPY order.
+var runColumns = []string{"id", "trace_id", "name", "inputs", "outputs", "metadata", "search_text", "metadata_attrs", "tags"}
+
+// idempotentRunID derives a stable run ID for the run at index i of a batch sent
+// with the given Idempotency-Key, so a retried batch maps onto the same rows.
+func idempotentRunID(key string, i int) uuid.UUID {
+	return uuid.NewSHA1(idempotencyNamespace, []byte(key+"/"+strconv.Itoa(i)))
+}
+
+// insertRuns writes rows to the runs table within tx and returns the IDs that already
+// existed. The common case is a single COPY; only when it hits a duplicate id do we roll
+// back to a savepoint and fall back to COPY into a staging table followed by
+// INSERT ... ON CONFLICT DO NOTHING.
+func insertRuns(ctx context.Context, tx pgx.Tx, rows [][]any) ([]string, error) {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db savepoint: %w", err)
+	}
+	copyCtx, span := tracer.Start(ctx, "db.CopyFrom", trace.WithAttributes(attribute.Int("rows", len(rows))))
+	start := time.Now()
+	_, err = sp.CopyFrom(copyCtx, pgx.Identifier{"runs"}, runColumns, pgx.CopyFromRows(rows))
+	dbCopyDuration.Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+	if err == nil {
+		if err := sp.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("db release savepoint: %w", err)
+		}
+		return nil, nil
+	}
+	_ = sp.Rollback(ctx)
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != pgUniqueViolation {
+		return nil, fmt.Errorf("db copy: %w", err)
+	}
+	return insertNewRuns(ctx, tx, rows)
+}
+
+// insertNewRuns loads rows into a transaction-scoped staging table and inserts those
+// whose id is not taken yet. Existing runs are left exactly as they are: their refs keep
+// pointing at the batch object they were stored with, and tags added since are kept.
+// A retried batch therefore cannot clobber anything, and neither can a client id that
+// collides with another run.
+func insertNewRuns(ctx context.Context, tx pgx.Tx, rows [][]any) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "db.insertNewRuns", trace.WithAttributes(attribute.Int("rows", len(rows))))
+	defer func() { endSpan(span, err) }()
+
+	if _, err := tx.Exec(ctx, `CREATE TEMP TABLE runs_staging (LIKE runs INCLUDING DEFAULTS) ON COMMIT DROP`); err != nil {
+		return nil, fmt.Errorf("db staging table: %w", err)
+	}
+	start := time.Now()
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"runs_staging"}, runColumns, pgx.CopyFromRows(rows))
+	dbCopyDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("db staging copy: %w", err)
+	}
+
+	res, err := tx.Query(ctx,
+		`INSERT INTO runs (id, trace_id, name, inputs, outputs, metadata, search_text, metadata_attrs, tags)
+		 SELECT id, trace_id, name, inputs, outputs, metadata, search_text, metadata_attrs, tags FROM runs_staging
+		 ON CONFLICT (id) DO NOTHING
+		 RETURNING id`)
+	if err != nil {
+		return nil, fmt.Errorf("db insert: %w", err)
+	}
+	inserted := make(map[uuid.UUID]bool, len(rows))
+	for res.Next() {
+		var id uuid.UUID
+		if err := res.Scan(&id); err != nil {
+			res.Close()
+			return nil, fmt.Errorf("db insert: %w", err)
+		}
+		inserted[id] = true
+	}
+	if err := res.Err(); err != nil {
+		return nil, fmt.Errorf("db insert: %w", err)
+	}
+	return existingRunIDs(rows, inserted), nil
+}
+
+// existingRunIDs returns the ids of rows that were not inserted, in row order.
+func existingRunIDs(rows [][]any, inserted map[uuid.UUID]bool) []string {
+	var existing []string
+	for _, row := range rows {
+		id := row[0].(uuid.UUID)
+		if !inserted[id] {
+			existing = append(existing, id.String())
+		}
+	}
+	return existing
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestExistingRunIDs(t *testing.T) {
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+	rows := [][]any{{a, "x"}, {b, "y"}, {c, "z"}}
+	got := existingRunIDs(rows, map[uuid.UUID]bool{b: true})
+	if want := []string{a.String(), c.String()}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := existingRunIDs(rows, map[uuid.UUID]bool{a: true, b: true, c: true}); got != nil {
+		t.Errorf("all inserted: got %v", got)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+// indexer derives the columns that make runs searchable and filterable from their raw
+// fields at ingest, so that queries never need to read S3.
+type indexer struct {
+	searchBytes  int
+	attrKeys     map[string]bool // nil indexes every key
+	maxAttrs     int
+	maxAttrValue int
+}
+
+func newIndexer(cfg *appconfig.Settings) indexer {
+	ix := indexer{
+		searchBytes:  cfg.SearchTextBytes,
+		maxAttrs:     cfg.MetadataAttrMaxKeys,
+		maxAttrValue: cfg.MetadataAttrMaxValueBytes,
+	}
+	if cfg.MetadataAttrKeys != "" {
+		ix.attrKeys = map[string]bool{}
+		for _, k := range strings.Split(cfg.MetadataAttrKeys, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				ix.attrKeys[k] = true
+			}
+		}
+	}
+	return ix
+}
+
+// index sets the search text and metadata attributes of ro from the run's fields.
+func (ix indexer) index(ro *runOffsets, inputs, outputs, metadata []byte) {
+	if ix.searchBytes > 0 {
+		text := extractSearchText(ix.searchBytes, inputs, outputs)
+		ro.search = &text
+	}
+	ro.attrs = ix.metadataAttrs(metadata)
+}
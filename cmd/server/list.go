@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// runSummary is one run of GET /runs. The fields themselves stay in S3; fetch them with
+// GET /runs/{id}.
+type runSummary struct {
+	ID            uuid.UUID       `json:"id"`
+	TraceID       uuid.UUID       `json:"trace_id"`
+	Name          string          `json:"name"`
+	Tags          []string        `json:"tags"`
+	CreatedAt     time.Time       `json:"created_at"`
+	MetadataAttrs json.RawMessage `json:"metadata_attrs,omitempty"`
+}
+
+// listRunsHandler lists stored runs, newest first, filtered by trace id, tags and the
+// metadata attributes indexed at ingest (see parseRunFilter).
+func (s *Server) listRunsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	f, err := parseRunFilter(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	queryCtx, span := tracer.Start(ctx, "listRuns.query")
+	// One extra row tells whether there is a next page.
+	rows, err := s.db.Query(queryCtx,
+		`SELECT id, trace_id, name, tags, created_at, metadata_attrs FROM runs
+		 WHERE `+f.where()+`
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT `+f.arg(limit+1)+` OFFSET `+f.arg(offset), f.args...)
+	runs := make([]runSummary, 0, limit+1)
+	if err == nil {
+		for rows.Next() {
+			var (
+				run   runSummary
+				attrs []byte
+			)
+			if err = rows.Scan(&run.ID, &run.TraceID, &run.Name, &run.Tags, &run.CreatedAt, &attrs); err != nil {
+				break
+			}
+			run.MetadataAttrs = attrs
+			runs = append(runs, run)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to list runs"})
+		return
+	}
+
+	resp := struct {
+		Runs       []runSummary `json:"runs"`
+		NextOffset *int         `json:"next_offset"`
+	}{Runs: runs}
+	if len(runs) > limit {
+		resp.Runs = runs[:limit]
+		next := offset + limit
+		resp.NextOffset = &next
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLoggerRequestID(t *testing.T) {
+	var seen string
+	h := requestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	}))
+
+	cases := []struct {
+		name, in string
+		keep     bool
+	}{
+		{"missing", "", false},
+		{"valid", "abc-123", true},
+		{"too long", strings.Repeat("a", maxRequestIDLen+1), false},
+		{"control chars", "abc\tdef", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/livez", nil)
+			if tc.in != "" {
+				req.Header.Set(requestIDHeader, tc.in)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get(requestIDHeader)
+			if got == "" || got != seen {
+				t.Fatalf("response id %q, context id %q", got, seen)
+			}
+			if tc.keep != (got == tc.in) {
+				t.Fatalf("id %q for input %q, keep=%v", got, tc.in, tc.keep)
+			}
+		})
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, lvl := range []string{"debug", "info", "WARN", "error"} {
+		if _, err := parseLogLevel(lvl); err != nil {
+			t.Errorf("parseLogLevel(%q): %v", lvl, err)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
@@ -3,26 +3,33 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/goccy/go-json"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
 )
@@ -32,6 +39,7 @@ type RunIn struct {
 	ID       *string        `json:"id,omitempty"`
 	TraceID  string         `json:"trace_id"`
 	Name     string         `json:"name"`
+	Tags     []string       `json:"tags"`
 	Inputs   map[string]any `json:"inputs"`
 	Outputs  map[string]any `json:"outputs"`
 	Metadata map[string]any `json:"metadata"`
@@ -42,16 +50,36 @@ type runJSON struct {
 	ID       *string         `json:"id"`
 	TraceID  string          `json:"trace_id"`
 	Name     string          `json:"name"`
+	Tags     []string        `json:"tags"`
 	Inputs   json.RawMessage `json:"inputs"`
 	Outputs  json.RawMessage `json:"outputs"`
 	Metadata json.RawMessage `json:"metadata"`
 }
 
 type Server struct {
-	cfg appconfig.Settings
-	dsn string
+	// cfg holds the current settings; reloads swap it atomically.
+	cfg atomic.Pointer[appconfig.Settings]
 	s3  *s3.Client
 	db  *pgxpool.Pool
+
+	// queue is non-nil when async ingestion is enabled.
+	queue *writeBehindQueue
+	// coalescer micro-batches small requests while CoalesceWindow is positive.
+	coalescer *coalescer
+	// ranges caches small field ranges read from S3; nil when disabled.
+	ranges *rangeCache
+	// batches keeps recently written batch objects; nil when disabled.
+	batches *batchCache
+
+	// writes tracks batch writes in flight so shutdown can wait for them; cancelling
+	// abortWrites makes the remaining ones roll back. Writes register through beginWrite,
+	// which refuses new ones once draining is set.
+	writes       sync.WaitGroup
+	writesMu     sync.Mutex
+	draining     bool
+	abortWrites  context.Context
+	cancelWrites context.CancelFunc
+	shuttingDown atomic.Bool
 }
 
 // bufferPool is used to reuse buffers for batch JSON construction
@@ -64,64 +92,281 @@ var bufferPool = sync.Pool{
 // copyBufPool provides reusable fixed-size buffers for io.CopyBuffer during streaming.
 var copyBufPool = sync.Pool{New: func() any { b := make([]byte, 32*1024); return &b }}
 
+// newServer wires a Server around its clients.
+func newServer(cfg appconfig.Settings, s3Client *s3.Client, db *pgxpool.Pool) *Server {
+	s := &Server{s3: s3Client, db: db}
+	s.cfg.Store(&cfg)
+	s.coalescer = newCoalescer(s, cfg.CoalesceWindow, cfg.CoalesceMaxRuns, cfg.CoalesceMaxBytes)
+	if cfg.RangeCacheBytes > 0 {
+		s.ranges = newRangeCache(cfg.RangeCacheBytes, cfg.RangeCacheMaxEntryBytes)
+	}
+	if cfg.BatchCacheBytes > 0 {
+		s.batches = newBatchCache(cfg.BatchCacheBytes, cfg.BatchCacheTTL)
+	}
+	s.abortWrites, s.cancelWrites = context.WithCancel(context.Background())
+	return s
+}
+
+// settings returns the current settings. Callers that read several fields should take
+// one snapshot so that a concurrent reload cannot mix old and new values.
+func (s *Server) settings() *appconfig.Settings {
+	return s.cfg.Load()
+}
+
 func main() {
 	ctx := context.Background()
 
 	// Load settings
-	settings := appconfig.Load()
-
-	// Build DSN for Postgres
-	dsn := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", settings.DBUser, settings.DBPassword, settings.DBHost, settings.DBPort, settings.DBName)
+	settings, args, err := appconfig.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("failed to load config", "error", err)
+	}
+	if err := setupLogging(settings.LogLevel); err != nil {
+		fatal("invalid logging config", "error", err)
+	}
 
 	// Init S3 client (communicate to MinIO locally)
-	awsCfg, err := awsconfig.LoadDefaultConfig(
-		ctx,
-		awsconfig.WithRegion(settings.S3Region),
-		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(settings.S3AccessKey, settings.S3SecretKey, "")),
-	)
+	s3Client, err := newS3Client(ctx, settings)
 	if err != nil {
-		log.Fatalf("failed to load AWS config: %v", err)
+		fatal("failed to load AWS config", "error", err)
 	}
-	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
-		o.UsePathStyle = true
-		o.BaseEndpoint = aws.String(settings.S3Endpoint)
-	})
 
-	dbpool, err := pgxpool.New(ctx, dsn)
+	poolCfg, err := newPoolConfig(settings)
 	if err != nil {
-		log.Fatalf("failed to create db pool: %v", err)
+		fatal("invalid database config", "error", err)
+	}
+	dbpool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	if err != nil {
+		fatal("failed to create db pool", "error", err)
 	}
 	defer dbpool.Close()
-	srv := &Server{cfg: settings, dsn: dsn, s3: s3Client, db: dbpool}
 
+	if len(args) > 0 {
+		if err := runCommand(ctx, settings, s3Client, dbpool, args); err != nil {
+			fatal("command failed", "command", args[0], "error", err)
+		}
+		return
+	}
+
+	if settings.DBAutoMigrate {
+		if err := applyMigrations(ctx, dbpool); err != nil {
+			fatal("failed to apply migrations", "error", err)
+		}
+	}
+	if settings.S3AutoCreateBucket {
+		if err := ensureBucket(ctx, s3Client, settings.S3BucketName); err != nil {
+			fatal("failed to ensure bucket", "bucket", settings.S3BucketName, "error", err)
+		}
+	}
+
+	shutdownTracing, err := setupTracing(ctx, settings)
+	if err != nil {
+		fatal("failed to set up tracing", "error", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.WithoutCancel(ctx)); err != nil {
+			slog.Error("tracing shutdown failed", "error", err)
+		}
+	}()
+
+	srv := newServer(settings, s3Client, dbpool)
+	prometheus.MustRegister(newPoolCollector(dbpool))
+	if srv.ranges != nil {
+		prometheus.MustRegister(srv.ranges.sizeGauge())
+	}
+	if srv.batches != nil {
+		prometheus.MustRegister(srv.batches.sizeGauge())
+	}
+	if settings.AsyncIngest {
+		q, err := newWriteBehindQueue(srv, settings.AsyncWALDir, settings.AsyncWorkers, settings.AsyncQueueSize)
+		if err != nil {
+			fatal("failed to start async ingest queue", "error", err)
+		}
+		srv.queue = q
+	}
+
+	addr := ":" + strconv.Itoa(settings.Port)
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           srv.routes(),
+		ReadHeaderTimeout: settings.HTTPReadHeaderTimeout,
+		ReadTimeout:       settings.HTTPReadTimeout,
+		WriteTimeout:      settings.HTTPWriteTimeout,
+		IdleTimeout:       settings.HTTPIdleTimeout,
+	}
+
+	sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go srv.watchConfig(sigCtx, os.Args[1:])
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "addr", addr)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		fatal("server failed", "error", err)
+	case <-sigCtx.Done():
+	}
+	stop()
+
+	// Fail readiness first so load balancers stop routing here, then drain.
+	srv.shuttingDown.Store(true)
+	cfg := srv.settings()
+	slog.Info("shutting down", "drain_timeout", cfg.ShutdownTimeout.String())
+	time.Sleep(cfg.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("http shutdown failed", "error", err)
+	}
+	if err := srv.drain(shutdownCtx); err != nil {
+		slog.Error("drain incomplete", "error", err)
+	}
+	slog.Info("shutdown complete")
+}
+
+// routes builds the HTTP router for the server.
+func (s *Server) routes() *chi.Mux {
 	r := chi.NewRouter()
-	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-	})
-	r.Post("/runs", srv.createRunsHandler)
-	r.Get("/runs/{id}", srv.getRunHandler)
+	r.Use(traceHTTP, requestLogger, instrumentHTTP)
+	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/livez", s.livezHandler)
+	r.Get("/readyz", s.readyzHandler)
+	// /healthz predates the split probes and, as before, only reports that the process is up.
+	r.Get("/healthz", s.livezHandler)
+	r.Post("/runs", s.createRunsHandler)
+	r.With(s.compressResponse).Get("/runs", s.listRunsHandler)
+	r.With(s.compressResponse).Get("/runs/search", s.searchRunsHandler)
+	r.With(s.compressResponse).Get("/runs/{id}", s.getRunHandler)
+	r.Post("/runs/{id}/tags", s.addTagsHandler)
+	r.Delete("/runs/{id}/tags/{tag}", s.removeTagHandler)
+	r.Post("/runs/{id}/feedback", s.createFeedbackHandler)
+	r.Get("/runs/{id}/feedback", s.listFeedbackHandler)
+	r.Delete("/runs/{id}/feedback/{feedback_id}", s.deleteFeedbackHandler)
+	r.Post("/feedback", s.createFeedbackBatchHandler)
+	r.Get("/feedback/stats", s.feedbackStatsHandler)
+	r.Get("/runs/{id}/fields/{field}", s.getRunFieldHandler)
+	return r
+}
+
+// writeContext returns the context for a request's batch write. It is not cancelled when
+// the client goes away, so a batch is never abandoned halfway, but it is cancelled when
+// shutdown gives up waiting so that unfinished writes roll back before the pool closes.
+func (s *Server) writeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	stop := context.AfterFunc(s.abortWrites, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// errShuttingDown is returned for batch writes that start after draining has begun.
+var errShuttingDown = errors.New("server is shutting down, retry later")
+
+// beginWrite registers a batch write so that drain waits for it, or reports false once
+// draining has begun. It must be called before handing the write to another goroutine,
+// and a successful call must be paired with s.writes.Done.
+func (s *Server) beginWrite() bool {
+	s.writesMu.Lock()
+	defer s.writesMu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.writes.Add(1)
+	return true
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+// drain completes background batch writes after the HTTP server has stopped accepting
+// requests. It must run before the DB pool is closed.
+func (s *Server) drain(ctx context.Context) error {
+	// Send the collecting micro-batch and stop the queue from taking new batches, so
+	// that everything still to be written has registered before we wait.
+	s.coalescer.flush()
+	if s.queue != nil {
+		s.queue.stop()
 	}
-	addr := ":" + port
-	log.Printf("Starting server on %s", addr)
-	if err := http.ListenAndServe(addr, r); err != nil {
-		log.Fatalf("server failed: %v", err)
+	s.writesMu.Lock()
+	s.draining = true
+	s.writesMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.writes.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("batch writes still in flight, rolling back: %w", ctx.Err())
+		s.cancelWrites()
+		if s.queue != nil {
+			s.queue.cancel()
+		}
+		<-done
 	}
+	// Stopping the queue rolls back any flush in progress; its batch stays in the WAL.
+	if s.queue != nil {
+		s.queue.close()
+	}
+	return err
 }
 
 // createRunsHandler accepts a payload of runs, uploads a batch JSON to S3 for large fields, and stores S3 refs in Postgres.
 func (s *Server) createRunsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	ctx := r.Context()
+	ctx, cancel := s.writeContext(r)
+	defer cancel()
 
 	// Parse runs. NOTE: feel free to change the format of the payload
 	var runs []runJSON
-	if err := json.NewDecoder(r.Body).Decode(&runs); err != nil {
+	_, decodeSpan := tracer.Start(ctx, "createRuns.decode")
+	cfg := s.settings()
+	body, err := openRequestBody(w, r, int64(cfg.MaxRequestBytes), int64(cfg.MaxDecompressedBytes))
+	if err != nil {
+		endSpan(decodeSpan, err)
+		if errors.Is(err, errUnsupportedEncoding) {
+			w.Header().Set("Accept-Encoding", "gzip, zstd")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Content-Encoding must be gzip or zstd"})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	err = json.NewDecoder(body).Decode(&runs)
+	body.close()
+	decodeSpan.SetAttributes(
+		attribute.Int("runs", len(runs)),
+		attribute.String("content_encoding", body.encoding),
+		attribute.Int64("body_bytes", body.wire.n),
+	)
+	endSpan(decodeSpan, err)
+	var (
+		tooLarge        *http.MaxBytesError
+		tooLargeDecoded errBodyTooLarge
+	)
+	switch {
+	case errors.As(body.err, &tooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)})
+		return
+	case errors.As(body.err, &tooLargeDecoded):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": tooLargeDecoded.Error()})
+		return
+	case body.err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("could not read request body: %v", body.err)})
+		return
+	case err != nil:
 		w.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON body, expected an array of runs"})
 		return
@@ -131,17 +376,29 @@ func (s *Server) createRunsHandler(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(map[string]string{"error": "No runs provided"})
 		return
 	}
+	if cfg.MaxBatchRuns > 0 && len(runs) > cfg.MaxBatchRuns {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("batch has %d runs, the limit is %d", len(runs), cfg.MaxBatchRuns)})
+		return
+	}
 
-	batchID := uuid.New().String()
-	objectKey := fmt.Sprintf("batches/%s.json", batchID)
+	idemKey := r.Header.Get(idempotencyHeader)
+	if len(idemKey) > maxIdempotencyKeyLen {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("%s must be at most %d bytes", idempotencyHeader, maxIdempotencyKeyLen)})
+		return
+	}
+	if idemKey != "" {
+		w.Header().Set(idempotencyHeader, idemKey)
+	}
 
-	type runOffsets struct {
-		id          uuid.UUID
-		traceID     uuid.UUID
-		name        string
-		inputsRef   string
-		outputsRef  string
-		metadataRef string
+	objectKey := newBatchKey()
+	est := estimateBatchSize(runs)
+
+	// Very large batches are streamed to S3 part-by-part instead of buffered whole.
+	if s.queue == nil && cfg.S3MultipartThreshold > 0 && est >= cfg.S3MultipartThreshold {
+		s.createLargeBatch(w, r, objectKey, runs, idemKey)
+		return
 	}
 
 	buf := bufferPool.Get().(*bytes.Buffer)
@@ -149,18 +406,170 @@ func (s *Server) createRunsHandler(w http.ResponseWriter, r *http.Request) {
 	defer bufferPool.Put(buf)
 
 	// Optional pre-grow: heuristic total size (tune factor)
+	if est > 0 && est < 64*1024*1024 {
+		buf.Grow(est)
+	}
+	_, serializeSpan := tracer.Start(ctx, "createRuns.serialize")
+	offs, err := buildBatch(buf, runs, idemKey, newIndexer(s.settings()))
+	serializeSpan.SetAttributes(attribute.Int("batch.bytes", buf.Len()))
+	endSpan(serializeSpan, err)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if s.queue != nil {
+		if err := s.queue.enqueue(objectKey, bytes.Clone(buf.Bytes()), offs); err != nil {
+			if errors.Is(err, errQueueFull) {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "accepted", "run_ids": runIDs(offs)})
+		return
+	}
+
+	var existing []string
+	if s.coalescer.accepts(buf.Len(), len(offs)) {
+		existing, err = s.coalescer.submit(buf.Bytes(), offs)
+	} else if s.beginWrite() {
+		existing, err = s.writeBatch(ctx, objectKey, buf.Bytes(), offs)
+		s.writes.Done()
+	} else {
+		err = errShuttingDown
+	}
+	if errors.Is(err, errShuttingDown) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeCreated(w, offs, existing)
+}
+
+// createLargeBatch serializes runs straight into an S3 multipart upload so that the
+// batch object never has to be held in memory as a whole.
+func (s *Server) createLargeBatch(w http.ResponseWriter, r *http.Request, objectKey string, runs []runJSON, idemKey string) {
+	ctx, cancel := s.writeContext(r)
+	defer cancel()
+	if !s.beginWrite() {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": errShuttingDown.Error()})
+		return
+	}
+	defer s.writes.Done()
+	cfg := s.settings()
+	mw, err := newMultipartWriter(ctx, s.s3, cfg.S3BucketName, objectKey, cfg.S3MultipartPartSize)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	_, serializeSpan := tracer.Start(ctx, "createRuns.serialize", trace.WithAttributes(attribute.Bool("multipart", true)))
+	offs, err := buildBatch(mw, runs, idemKey, newIndexer(cfg))
+	serializeSpan.SetAttributes(attribute.Int("batch.bytes", mw.Len()))
+	endSpan(serializeSpan, err)
+	if err != nil {
+		mw.abort(ctx)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	existing, err := s.storeBatch(ctx, mw.complete, offs, objectKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	writeCreated(w, offs, existing)
+}
+
+// writeCreated writes the 201 response for a stored batch.
+func writeCreated(w http.ResponseWriter, offs []runOffsets, existing []string) {
+	w.WriteHeader(http.StatusCreated)
+	if existing == nil {
+		existing = []string{}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "created", "run_ids": runIDs(offs), "existing_run_ids": existing})
+}
+
+// runIDs lists the IDs of the runs in a batch, in request order.
+func runIDs(offs []runOffsets) []string {
+	ids := make([]string, 0, len(offs))
+	for _, ro := range offs {
+		ids = append(ids, ro.id.String())
+	}
+	return ids
+}
+
+// estimateBatchSize is a heuristic for the serialized size of runs.
+func estimateBatchSize(runs []runJSON) int {
 	var est int
 	for _, rj := range runs {
 		est += len(rj.Inputs) + len(rj.Outputs) + len(rj.Metadata) + 256
 	}
-	if est > 0 && est < 64*1024*1024 {
-		buf.Grow(est)
-	}
+	return est
+}
+
+// byteRange is a half-open [start, end) span of a batch object.
+type byteRange struct {
+	start, end int
+}
+
+// runOffsets locates one run's fields inside a serialized batch object.
+type runOffsets struct {
+	id       uuid.UUID
+	traceID  uuid.UUID
+	name     string
+	inputs   byteRange
+	outputs  byteRange
+	metadata byteRange
+	// search is the text indexed for full-text search, or nil when indexing is off.
+	search *string
+	// attrs holds the indexed metadata attributes as a JSON object, or nil.
+	attrs []byte
+	// tags are kept in Postgres only, since they can change after ingestion.
+	tags []string
+}
+
+// ref formats an S3 ref like s3://bucket/key#start:end/field.
+func (br byteRange) ref(bucket, objectKey, field string) string {
+	return fmt.Sprintf("s3://%s/%s#%d:%d/%s", bucket, objectKey, br.start, br.end, field)
+}
 
+// buildBatch validates runs and serializes them into buf as a JSON array, recording
+// the byte range of every large field and the columns ix derives from the fields.
+// Returned errors describe a bad request.
+func buildBatch(buf batchWriter, runs []runJSON, idemKey string, ix indexer) ([]runOffsets, error) {
 	buf.WriteByte('[')
 	offs := make([]runOffsets, 0, len(runs))
 
 	quoteBuf := make([]byte, 0, 128)
+	seen := make(map[uuid.UUID]struct{}, len(runs))
+
+	writeField := func(raw json.RawMessage) byteRange {
+		start := buf.Len()
+		if len(raw) == 0 {
+			buf.WriteString(`{}`)
+		} else {
+			// RawMessage: write directly (must be valid JSON)
+			buf.Write(raw)
+		}
+		return byteRange{start: start, end: buf.Len()}
+	}
 
 	for i, in := range runs {
 		// id
@@ -169,19 +578,25 @@ func (s *Server) createRunsHandler(w http.ResponseWriter, r *http.Request) {
 			var err error
 			id, err = uuid.Parse(*in.ID)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("invalid id at index %d", i)})
-				return
+				return nil, fmt.Errorf("invalid id at index %d", i)
 			}
+		} else if idemKey != "" {
+			id = idempotentRunID(idemKey, i)
 		} else {
 			id = uuid.New()
 		}
+		if _, dup := seen[id]; dup {
+			return nil, fmt.Errorf("duplicate id at index %d", i)
+		}
+		seen[id] = struct{}{}
+		tags, err := normalizeTags(in.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tags at index %d: %v", i, err)
+		}
 		// trace_id
 		traceID, err := uuid.Parse(in.TraceID)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("invalid trace_id at index %d", i)})
-			return
+			return nil, fmt.Errorf("invalid trace_id at index %d", i)
 		}
 
 		if i > 0 {
@@ -197,137 +612,152 @@ func (s *Server) createRunsHandler(w http.ResponseWriter, r *http.Request) {
 		quoteBuf = strconv.AppendQuote(quoteBuf[:0], in.Name)
 		buf.Write(quoteBuf)
 
-		// inputs
+		ro := runOffsets{id: id, traceID: traceID, name: in.Name, tags: tags}
 		buf.WriteString(`,"inputs":`)
-		inputsStart := buf.Len()
-		if len(in.Inputs) == 0 {
-			buf.WriteString(`{}`)
-		} else {
-			// RawMessage: write directly (must be valid JSON)
-			buf.Write(in.Inputs)
-		}
-		inputsEnd := buf.Len()
-
-		// outputs
+		ro.inputs = writeField(in.Inputs)
 		buf.WriteString(`,"outputs":`)
-		outputsStart := buf.Len()
-		if len(in.Outputs) == 0 {
-			buf.WriteString(`{}`)
-		} else {
-			buf.Write(in.Outputs)
-		}
-		outputsEnd := buf.Len()
-
-		// metadata
+		ro.outputs = writeField(in.Outputs)
 		buf.WriteString(`,"metadata":`)
-		metadataStart := buf.Len()
-		if len(in.Metadata) == 0 {
-			buf.WriteString(`{}`)
-		} else {
-			buf.Write(in.Metadata)
-		}
-		metadataEnd := buf.Len()
-
+		ro.metadata = writeField(in.Metadata)
 		buf.WriteByte('}')
+		ix.index(&ro, in.Inputs, in.Outputs, in.Metadata)
 
-		offs = append(offs, runOffsets{
-			id:          id,
-			traceID:     traceID,
-			name:        in.Name,
-			inputsRef:   fmt.Sprintf("s3://%s/%s#%d:%d/inputs", s.cfg.S3BucketName, objectKey, inputsStart, inputsEnd),
-			outputsRef:  fmt.Sprintf("s3://%s/%s#%d:%d/outputs", s.cfg.S3BucketName, objectKey, outputsStart, outputsEnd),
-			metadataRef: fmt.Sprintf("s3://%s/%s#%d:%d/metadata", s.cfg.S3BucketName, objectKey, metadataStart, metadataEnd),
-		})
+		offs = append(offs, ro)
 	}
 	buf.WriteByte(']')
-	// Return buffer to pool after use
-	bufReader := bytes.NewReader(buf.Bytes())
-	var (
-		runIDs []string
-		mu     sync.Mutex
-		s3Err  error
-		dbErr  error
-	)
-
-	g := new(errgroup.Group)
+	return offs, nil
+}
 
-	// S3 upload
-	g.Go(func() error {
+// writeBatch uploads body to S3 under objectKey while concurrently inserting the run rows
+// that reference it. It returns the IDs of runs that already existed.
+func (s *Server) writeBatch(ctx context.Context, objectKey string, body []byte, offs []runOffsets) ([]string, error) {
+	upload := func(ctx context.Context) error {
+		ctx, span := tracer.Start(ctx, "s3.PutObject", s3ObjectAttrs(s.settings().S3BucketName, objectKey, 0, 0))
+		start := time.Now()
 		_, err := s.s3.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:      aws.String(s.cfg.S3BucketName),
+			Bucket:      aws.String(s.settings().S3BucketName),
 			Key:         aws.String(objectKey),
-			Body:        bufReader,
+			Body:        bytes.NewReader(body),
 			ContentType: aws.String("application/json"),
 		})
+		observeS3("PutObject", start, err)
+		endSpan(span, err)
 		if err != nil {
-			mu.Lock()
-			s3Err = fmt.Errorf("s3 upload: %w", err)
-			mu.Unlock()
+			return fmt.Errorf("s3 upload: %w", err)
 		}
+		s3BytesWrittenTotal.Add(float64(len(body)))
+		return nil
+	}
+	existing, err := s.storeBatch(ctx, upload, offs, objectKey)
+	if err == nil && len(existing) < len(offs) {
+		s.batches.add(s.settings().S3BucketName, objectKey, body)
+	}
+	return existing, err
+}
+
+// storeBatch runs upload, which finishes storing the batch object, concurrently with
+// inserting the run rows that reference objectKey. The rows are committed only once the
+// upload has succeeded, and the object is deleted again if no row ends up referencing
+// it, so a failed or fully duplicate batch leaves nothing behind.
+func (s *Server) storeBatch(ctx context.Context, upload func(context.Context) error, offs []runOffsets, objectKey string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "storeBatch", trace.WithAttributes(
+		attribute.String("s3.key", objectKey),
+		attribute.Int("runs", len(offs)),
+	))
+	var (
+		existingIDs []string
+		s3Err       error
+		dbErr       error
+	)
+	defer func() { endSpan(span, errors.Join(s3Err, dbErr)) }()
+	uploaded := make(chan error, 1)
+
+	g := new(errgroup.Group)
+
+	// S3 upload
+	g.Go(func() error {
+		s3Err = upload(ctx)
+		uploaded <- s3Err
 		return nil // swallow to allow DB goroutine to finish
 	})
 
 	// DB batch insert
 	g.Go(func() error {
-		conn, err := s.db.Acquire(ctx)
-		if err != nil {
-			mu.Lock()
-			dbErr = fmt.Errorf("db acquire: %w", err)
-			mu.Unlock()
-			return nil
-		}
-		defer conn.Release()
+		existingIDs, dbErr = s.insertBatchRows(ctx, offs, objectKey, uploaded)
+		return nil
+	})
 
-		rows := make([][]any, 0, len(offs))
-		localIDs := make([]string, 0, len(offs))
-		for _, ro := range offs {
-			rows = append(rows, []any{ro.id, ro.traceID, ro.name, ro.inputsRef, ro.outputsRef, ro.metadataRef})
-			localIDs = append(localIDs, ro.id.String())
-		}
+	_ = g.Wait()
 
-		_, err = conn.CopyFrom(
-			ctx,
-			pgx.Identifier{"runs"},
-			[]string{"id", "trace_id", "name", "inputs", "outputs", "metadata"},
-			pgx.CopyFromRows(rows),
-		)
+	// Nothing references the object if the rows were rolled back, or if every run in the
+	// batch already existed and was left alone.
+	if s3Err == nil && (dbErr != nil || len(existingIDs) == len(offs)) {
+		_, err := s.s3.DeleteObject(context.WithoutCancel(ctx), &s3.DeleteObjectInput{
+			Bucket: aws.String(s.settings().S3BucketName),
+			Key:    aws.String(objectKey),
+		})
 		if err != nil {
-			mu.Lock()
-			dbErr = fmt.Errorf("db copy: %w", err)
-			mu.Unlock()
-			return nil
+			slog.ErrorContext(ctx, "s3 delete of unreferenced batch failed", "batch_key", objectKey, "error", err)
 		}
+	}
 
-		mu.Lock()
-		runIDs = localIDs
-		mu.Unlock()
-		return nil
-	})
+	if s3Err != nil || dbErr != nil {
+		// Joined rather than flattened, so that callers can tell what failed.
+		return nil, errors.Join(s3Err, dbErr)
+	}
+	runsIngestedTotal.Add(float64(len(offs) - len(existingIDs)))
+	batchRuns.Observe(float64(len(offs)))
+	return existingIDs, nil
+}
 
-	_ = g.Wait()
+// insertBatchRows inserts the rows for a batch in a transaction and commits it only if
+// the upload reported on uploaded succeeds; otherwise the rows are rolled back.
+func (s *Server) insertBatchRows(ctx context.Context, offs []runOffsets, objectKey string, uploaded <-chan error) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "db.insertBatchRows")
+	defer func() { endSpan(span, err) }()
 
-	mu.Lock()
-	se := s3Err
-	de := dbErr
-	ids := runIDs
-	mu.Unlock()
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db acquire: %w", err)
+	}
+	defer conn.Release()
 
-	if se != nil || de != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		var msg strings.Builder
-		if se != nil {
-			msg.WriteString(se.Error())
-			msg.WriteString(". ")
-		}
-		if de != nil {
-			msg.WriteString(de.Error())
-		}
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": msg.String()})
-		return
+	bucket := s.settings().S3BucketName
+	rows := make([][]any, 0, len(offs))
+	for _, ro := range offs {
+		rows = append(rows, []any{
+			ro.id, ro.traceID, ro.name,
+			ro.inputs.ref(bucket, objectKey, "inputs"),
+			ro.outputs.ref(bucket, objectKey, "outputs"),
+			ro.metadata.ref(bucket, objectKey, "metadata"),
+			ro.search,
+			ro.attrs,
+			ro.tags,
+		})
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(map[string]any{"status": "created", "run_ids": ids})
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback(context.WithoutCancel(ctx)) }()
+
+	existing, err := insertRuns(ctx, tx, rows)
+	if err != nil {
+		return nil, err
+	}
+	_, waitSpan := tracer.Start(ctx, "db.awaitUpload")
+	uploadErr := <-uploaded
+	waitSpan.End()
+	if uploadErr != nil {
+		// The upload error is reported by the caller; the deferred rollback undoes the rows.
+		span.SetAttributes(attribute.Bool("rolled_back", true))
+		return nil, nil
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("db commit: %w", err)
+	}
+	return existing, nil
 }
 
 // getRunHandler fetches a run by ID and resolves S3 byte-range refs for inputs/outputs/metadata.
@@ -341,9 +771,27 @@ func (s *Server) getRunHandler(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(map[string]string{"error": "id must be a valid UUID"})
 		return
 	}
+	presign := false
+	if v := r.URL.Query().Get("presign"); v != "" {
+		if presign, err = strconv.ParseBool(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "presign must be true or false"})
+			return
+		}
+	}
 
-	conn, err := s.db.Acquire(ctx)
+	// Runs accepted asynchronously are served from memory until they are flushed.
+	if s.queue != nil {
+		if pr, ok := s.queue.lookup(id); ok {
+			writePendingRun(w, pr)
+			return
+		}
+	}
+
+	queryCtx, querySpan := tracer.Start(ctx, "getRun.query")
+	conn, err := s.db.Acquire(queryCtx)
 	if err != nil {
+		endSpan(querySpan, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to acquire database connection"})
 		return
@@ -354,14 +802,16 @@ func (s *Server) getRunHandler(w http.ResponseWriter, r *http.Request) {
 		outID       uuid.UUID
 		traceID     uuid.UUID
 		name        string
+		tags        []string
 		inputsRef   string
 		outputsRef  string
 		metadataRef string
 	)
-	err = conn.QueryRow(ctx,
-		`SELECT id, trace_id, name, COALESCE(inputs, ''), COALESCE(outputs, ''), COALESCE(metadata, '')
+	err = conn.QueryRow(queryCtx,
+		`SELECT id, trace_id, name, tags, COALESCE(inputs, ''), COALESCE(outputs, ''), COALESCE(metadata, '')
 		 FROM runs WHERE id = $1`, id,
-	).Scan(&outID, &traceID, &name, &inputsRef, &outputsRef, &metadataRef)
+	).Scan(&outID, &traceID, &name, &tags, &inputsRef, &outputsRef, &metadataRef)
+	endSpan(querySpan, err)
 	if err != nil {
 		// Not found or other error
 		w.WriteHeader(http.StatusNotFound)
@@ -369,6 +819,20 @@ func (s *Server) getRunHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if presign {
+		// Presigned URLs expire, so the response must not outlive them in a cache.
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		// The ETag comes from the row alone, so revalidation never touches S3.
+		etag := runETag(outID, traceID, name, tags, inputsRef, outputsRef, metadataRef)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", s.runCacheControl(outputsRef))
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	fields := []struct {
 		key string
 		ref string
@@ -378,46 +842,121 @@ func (s *Server) getRunHandler(w http.ResponseWriter, r *http.Request) {
 		{"metadata", metadataRef},
 	}
 	type stream struct {
-		key   string
-		ref   string
-		body  io.ReadCloser
-		errCh <-chan error
+		key        string
+		ref        string
+		objectKey  string
+		start, end int
+		presigned  []byte
+		body       io.ReadCloser
+		errCh      <-chan error
 	}
+	cfg := s.settings()
 	streams := make([]stream, 0, len(fields))
+	presignedKeys := []string{}
 	for _, f := range fields {
-		rc, errCh := s.openS3RangePipe(ctx, f.ref)
-		streams = append(streams, stream{key: f.key, ref: f.ref, body: rc, errCh: errCh})
+		bucket, objectKey, start, end, ok := s.parseS3Ref(f.ref)
+		st := stream{key: f.key, ref: f.ref, objectKey: objectKey, start: start, end: end}
+		if presign && ok && end-start > cfg.PresignThresholdBytes {
+			if st.presigned, err = s.presignField(ctx, bucket, objectKey, start, end, cfg.PresignTTL); err != nil {
+				slog.ErrorContext(ctx, "presign field failed", "run_id", outID.String(), "field", f.key, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to presign field"})
+				return
+			}
+			presignedKeys = append(presignedKeys, f.key)
+		}
+		streams = append(streams, st)
 	}
+	// Fields are fetched concurrently; each is written in order once it is its turn.
+	for i := range streams {
+		if streams[i].presigned == nil {
+			streams[i].body, streams[i].errCh = s.openS3RangePipe(ctx, streams[i].ref)
+		}
+	}
+	// Closing unread streams stops their fetches if the response is aborted.
+	defer func() {
+		for _, st := range streams {
+			if st.body != nil {
+				_ = st.body.Close()
+			}
+		}
+	}()
 
 	w.WriteHeader(http.StatusOK)
 
 	writeField := func(prefix string, st stream) {
 		_, _ = w.Write([]byte(prefix)) // static JSON
+		if st.presigned != nil {
+			_, _ = w.Write(st.presigned)
+			return
+		}
 		if st.body == nil {
 			_, _ = w.Write([]byte(`{}`))
 			return
 		}
+		// This span covers waiting on S3 as well as writing to the client.
+		_, span := tracer.Start(ctx, "getRun.writeField", trace.WithAttributes(attribute.String("field", st.key)))
 		bufPtr := copyBufPool.Get().(*[]byte)
 		copyBuf := *bufPtr
-		_, copyErr := io.CopyBuffer(w, st.body, copyBuf)
+		n, copyErr := io.CopyBuffer(w, st.body, copyBuf)
 		copyBufPool.Put(bufPtr)
 		closeErr := st.body.Close()
 		err := <-st.errCh
+		span.SetAttributes(attribute.Int64("bytes", n))
+		endSpan(span, errors.Join(copyErr, closeErr, err))
 		if copyErr != nil || closeErr != nil || err != nil {
-			log.Printf("stream field %s errors: copy=%v close=%v fetch=%v", st.key, copyErr, closeErr, err)
-			// fallback empty object if error (optional)
-			_, _ = w.Write([]byte(`{}`))
-			return
+			slog.ErrorContext(ctx, "stream field failed",
+				"run_id", outID.String(),
+				"field", st.key,
+				"batch_key", st.objectKey,
+				"range_start", st.start,
+				"range_end", st.end,
+				"copy_error", copyErr,
+				"close_error", closeErr,
+				"fetch_error", err,
+			)
+			// The status and ETag are already sent, so any body written now would be
+			// cached as this run. Abort the response instead so the client sees it failed.
+			panic(http.ErrAbortHandler)
 		}
 	}
 
 	_, _ = w.Write([]byte(`{"id":"` + outID.String() + `","trace_id":"` + traceID.String() + `","name":`))
 	nameBuf, _ := json.Marshal(name)
 	_, _ = w.Write(nameBuf)
+	tagsBuf, _ := json.Marshal(tags)
+	_, _ = w.Write([]byte(`,"tags":`))
+	_, _ = w.Write(tagsBuf)
 
 	writeField(`,"inputs":`, streams[0])
 	writeField(`,"outputs":`, streams[1])
 	writeField(`,"metadata":`, streams[2])
+	if presign {
+		keysBuf, _ := json.Marshal(presignedKeys)
+		_, _ = w.Write([]byte(`,"presigned_fields":`))
+		_, _ = w.Write(keysBuf)
+	}
+	_, _ = w.Write([]byte(`}`))
+}
+
+// writePendingRun writes a run that is still waiting in the write-behind queue. It has no
+// final refs yet, hence no ETag, and must not be cached.
+func writePendingRun(w http.ResponseWriter, pr pendingRun) {
+	body := pr.batch.body
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"id":"` + pr.offs.id.String() + `","trace_id":"` + pr.offs.traceID.String() + `","name":`))
+	nameBuf, _ := json.Marshal(pr.offs.name)
+	_, _ = w.Write(nameBuf)
+	tagsBuf, _ := json.Marshal(pr.offs.tags)
+	_, _ = w.Write([]byte(`,"tags":`))
+	_, _ = w.Write(tagsBuf)
+	_, _ = w.Write([]byte(`,"inputs":`))
+	_, _ = w.Write(body[pr.offs.inputs.start:pr.offs.inputs.end])
+	_, _ = w.Write([]byte(`,"outputs":`))
+	_, _ = w.Write(body[pr.offs.outputs.start:pr.offs.outputs.end])
+	_, _ = w.Write([]byte(`,"metadata":`))
+	_, _ = w.Write(body[pr.offs.metadata.start:pr.offs.metadata.end])
 	_, _ = w.Write([]byte(`}`))
 }
 
@@ -460,17 +999,47 @@ func (s *Server) openS3RangePipe(ctx context.Context, ref string) (io.ReadCloser
 	if !ok || bucket == "" || key == "" || end <= start {
 		return nil, make(chan error, 1) // empty errCh
 	}
-	rng := fmt.Sprintf("bytes=%d-%d", start, end-1)
+	return s.openS3Range(ctx, bucket, key, start, end)
+}
+
+// openS3Range streams bytes [start, end) of an object like openS3RangePipe. Recently
+// written batches and small ranges are served from the in-process caches.
+func (s *Server) openS3Range(ctx context.Context, bucket, key string, start, end int) (io.ReadCloser, <-chan error) {
 	pr, pw := io.Pipe()
 	errCh := make(chan error, 1)
+	fresh, fromBatch := s.batches.get(bucket, key, start, end)
+	if fromBatch || s.ranges.cacheable(end-start) {
+		go func() {
+			defer close(errCh)
+			b, err := fresh, error(nil)
+			if !fromBatch {
+				cacheKey := fmt.Sprintf("%s/%s#%d:%d", bucket, key, start, end)
+				b, err = s.ranges.get(ctx, cacheKey, func(ctx context.Context) ([]byte, error) {
+					return s.readS3Range(ctx, bucket, key, start, end)
+				})
+			}
+			if err == nil {
+				_, err = pw.Write(b)
+			}
+			pw.CloseWithError(err)
+			errCh <- err
+		}()
+		return pr, errCh
+	}
+	rng := fmt.Sprintf("bytes=%d-%d", start, end-1)
 	go func() {
 		defer close(errCh)
+		ctx, span := tracer.Start(ctx, "s3.GetRange", s3ObjectAttrs(bucket, key, start, end))
+		began := time.Now()
 		out, err := s.s3.GetObject(ctx, &s3.GetObjectInput{
 			Bucket: aws.String(bucket),
 			Key:    aws.String(key),
 			Range:  aws.String(rng),
 		})
+		// Recorded before the body is copied, which is paced by the client reading it.
+		observeS3("GetObject", began, err)
 		if err != nil {
+			endSpan(span, err)
 			pw.CloseWithError(err)
 			errCh <- err
 			return
@@ -481,6 +1050,7 @@ func (s *Server) openS3RangePipe(ctx context.Context, ref string) (io.ReadCloser
 		copyBuf := *bufPtr
 		_, copyErr := io.CopyBuffer(pw, out.Body, copyBuf)
 		copyBufPool.Put(bufPtr)
+		endSpan(span, copyErr)
 		if copyErr != nil {
 			pw.CloseWithError(copyErr)
 			errCh <- copyErr
@@ -4,16 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -32,36 +32,49 @@ func newTestRouter(tb testing.TB) (*chi.Mux, *Server) {
 	}
 
 	// Provide sensible defaults if .env.test isn't present
-	cfg := appconfig.Load()
+	cfg, _, err := appconfig.Load(nil)
+	if err != nil {
+		tb.Fatalf("failed to load config: %v", err)
+	}
 
 	// Build S3 client matching main.go
 	ctx := context.Background()
-	awsCfg, err := awsconfig.LoadDefaultConfig(
-		ctx,
-		awsconfig.WithRegion(cfg.S3Region),
-		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.S3AccessKey, cfg.S3SecretKey, "")),
-	)
+	s3Client, err := newS3Client(ctx, cfg)
 	if err != nil {
 		tb.Fatalf("failed to load AWS config: %v", err)
 	}
-	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
-		o.UsePathStyle = true
-		o.BaseEndpoint = aws.String(cfg.S3Endpoint)
-	})
 
-	dsn := "postgres://" + cfg.DBUser + ":" + cfg.DBPassword + "@" + cfg.DBHost + ":" + cfg.DBPort + "/" + cfg.DBName
-	dbpool, err := pgxpool.New(ctx, dsn)
+	poolCfg, err := newPoolConfig(cfg)
+	if err != nil {
+		tb.Fatalf("invalid database config: %v", err)
+	}
+	dbpool, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		tb.Fatalf("failed to create db pool: %v", err)
 	}
-	srv := &Server{cfg: cfg, dsn: dsn, s3: s3Client, db: dbpool}
+	srv := newServer(cfg, s3Client, dbpool)
 
-	r := chi.NewRouter()
-	r.Post("/runs", srv.createRunsHandler)
-	r.Get("/runs/{id}", srv.getRunHandler)
-	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	return srv.routes(), srv
+}
 
-	return r, srv
+// postRuns sends body to POST /runs, requires a 201 and returns the created run ids.
+func postRuns(t *testing.T, ts *httptest.Server, body []byte) []string {
+	t.Helper()
+	resp, err := http.Post(ts.URL+"/runs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /runs failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /runs: expected status 201, got %d", resp.StatusCode)
+	}
+	var created struct {
+		RunIDs []string `json:"run_ids"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("failed decoding response: %v", err)
+	}
+	return created.RunIDs
 }
 
 func TestCreateAndGetRun(t *testing.T) {
@@ -162,3 +175,622 @@ func normalizeJSON(v any) any {
 	_ = json.Unmarshal(b, &out)
 	return out
 }
+
+func TestGetRunConditional(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	body := makeRunsBody(1, 1)
+	runIDs := postRuns(t, ts, body)
+	if len(runIDs) != 1 {
+		t.Fatalf("POST /runs returned ids %v, want 1", runIDs)
+	}
+	url := ts.URL + "/runs/" + runIDs[0]
+
+	first, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	first.Body.Close()
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d %q", first.StatusCode, etag)
+	}
+	if first.Header.Get("Cache-Control") == "" {
+		t.Fatal("expected a Cache-Control header")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("If-None-Match", etag)
+	again, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("conditional GET failed: %v", err)
+	}
+	n, _ := io.Copy(io.Discard, again.Body)
+	again.Body.Close()
+	if again.StatusCode != http.StatusNotModified || n != 0 {
+		t.Fatalf("expected an empty 304, got %d with %d bytes", again.StatusCode, n)
+	}
+	if again.Header.Get("ETag") != etag {
+		t.Fatalf("304 ETag = %q, want %q", again.Header.Get("ETag"), etag)
+	}
+
+	req.Header.Set("If-None-Match", `"stale"`)
+	stale, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("conditional GET failed: %v", err)
+	}
+	stale.Body.Close()
+	if stale.StatusCode != http.StatusOK {
+		t.Fatalf("stale ETag: expected 200, got %d", stale.StatusCode)
+	}
+}
+
+func TestGetRunPresigned(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+	cfg := *srv.settings()
+	cfg.PresignThresholdBytes = 0 // presign every non-empty field
+	srv.cfg.Store(&cfg)
+
+	runIDs := postRuns(t, ts, makeRunsBody(1, 1))
+	if len(runIDs) != 1 {
+		t.Fatalf("POST /runs returned ids %v, want 1", runIDs)
+	}
+
+	got, err := http.Get(ts.URL + "/runs/" + runIDs[0] + "?presign=true")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	var run struct {
+		Inputs          presignedField `json:"inputs"`
+		PresignedFields []string       `json:"presigned_fields"`
+	}
+	err = json.NewDecoder(got.Body).Decode(&run)
+	got.Body.Close()
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Fatalf("GET ?presign=true: status %d, decode error %v", got.StatusCode, err)
+	}
+	if got.Header.Get("ETag") != "" || got.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("presigned response should be no-store without an ETag, got %q %q", got.Header.Get("ETag"), got.Header.Get("Cache-Control"))
+	}
+	if !slices.Contains(run.PresignedFields, "inputs") || run.Inputs.URL == "" {
+		t.Fatalf("inputs not presigned: %+v", run)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, run.Inputs.URL, nil)
+	req.Header.Set("Range", run.Inputs.Range)
+	field, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET presigned URL failed: %v", err)
+	}
+	data, _ := io.ReadAll(field.Body)
+	field.Body.Close()
+	if field.StatusCode != http.StatusPartialContent || len(data) != run.Inputs.Bytes || !json.Valid(data) {
+		t.Fatalf("presigned fetch: status %d, %d bytes (want %d), valid JSON %v", field.StatusCode, len(data), run.Inputs.Bytes, json.Valid(data))
+	}
+}
+
+func TestGetRunField(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	runIDs := postRuns(t, ts, makeRunsBody(1, 4))
+	if len(runIDs) != 1 {
+		t.Fatalf("POST /runs returned ids %v, want 1", runIDs)
+	}
+	runURL := ts.URL + "/runs/" + runIDs[0]
+
+	full, err := http.Get(runURL)
+	if err != nil {
+		t.Fatalf("GET run failed: %v", err)
+	}
+	var run struct {
+		Outputs json.RawMessage `json:"outputs"`
+	}
+	_ = json.NewDecoder(full.Body).Decode(&run)
+	full.Body.Close()
+
+	get := func(rng string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, runURL+"/fields/outputs", nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET field failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data
+	}
+
+	resp, data := get("")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(data, run.Outputs) {
+		t.Fatalf("whole field: status %d, %d bytes, want %d", resp.StatusCode, len(data), len(run.Outputs))
+	}
+	resp, data = get("bytes=10-1033")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(data, run.Outputs[10:1034]) {
+		t.Fatalf("range: status %d, %d bytes", resp.StatusCode, len(data))
+	}
+	if want := fmt.Sprintf("bytes 10-1033/%d", len(run.Outputs)); resp.Header.Get("Content-Range") != want {
+		t.Errorf("Content-Range = %q, want %q", resp.Header.Get("Content-Range"), want)
+	}
+	resp, _ = get(fmt.Sprintf("bytes=%d-", len(run.Outputs)))
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: status %d, want 416", resp.StatusCode)
+	}
+
+	unknown, err := http.Get(runURL + "/fields/secrets")
+	if err != nil {
+		t.Fatalf("GET unknown field failed: %v", err)
+	}
+	unknown.Body.Close()
+	if unknown.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown field: status %d, want 404", unknown.StatusCode)
+	}
+}
+
+func TestSearchRuns(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	// A made-up word keeps earlier test data from matching.
+	word := "zq" + strings.ReplaceAll(uuid.NewString()[:8], "-", "")
+	runs := []map[string]any{
+		{"trace_id": uuid.NewString(), "name": "search target", "outputs": map[string]any{"answer": "the model said " + word}},
+		{"trace_id": uuid.NewString(), "name": "unrelated", "outputs": map[string]any{"answer": "nothing to see"}},
+	}
+	body, _ := json.Marshal(runs)
+	runIDs := postRuns(t, ts, body)
+	if len(runIDs) != 2 {
+		t.Fatalf("POST /runs returned ids %v, want 2", runIDs)
+	}
+
+	got, err := http.Get(ts.URL + "/runs/search?q=" + word)
+	if err != nil {
+		t.Fatalf("GET /runs/search failed: %v", err)
+	}
+	var res struct {
+		Runs []struct {
+			ID      string `json:"id"`
+			Snippet string `json:"snippet"`
+		} `json:"runs"`
+		NextOffset *int `json:"next_offset"`
+	}
+	err = json.NewDecoder(got.Body).Decode(&res)
+	got.Body.Close()
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Fatalf("search: status %d, decode error %v", got.StatusCode, err)
+	}
+	if len(res.Runs) != 1 || res.Runs[0].ID != runIDs[0] || res.NextOffset != nil {
+		t.Fatalf("expected only run %s, got %+v", runIDs[0], res)
+	}
+	if !strings.Contains(res.Runs[0].Snippet, word) {
+		t.Errorf("snippet %q does not contain the match", res.Runs[0].Snippet)
+	}
+
+	missing, err := http.Get(ts.URL + "/runs/search")
+	if err != nil {
+		t.Fatalf("GET /runs/search failed: %v", err)
+	}
+	missing.Body.Close()
+	if missing.StatusCode != http.StatusBadRequest {
+		t.Errorf("search without q: status %d, want 400", missing.StatusCode)
+	}
+}
+
+func TestListRunsMetadataFilter(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	// A unique model name keeps earlier test data out of the results.
+	model := "model-" + uuid.NewString()
+	runs := []map[string]any{
+		{"trace_id": uuid.NewString(), "name": "small", "metadata": map[string]any{"model": model, "tokens": 5}},
+		{"trace_id": uuid.NewString(), "name": "large", "metadata": map[string]any{"model": model, "tokens": 50, "user": "u1"}},
+		// A string where the others have numbers must not break numeric comparisons.
+		{"trace_id": uuid.NewString(), "name": "text", "metadata": map[string]any{"model": model, "tokens": "many"}},
+	}
+	body, _ := json.Marshal(runs)
+	postRuns(t, ts, body)
+
+	list := func(filter string) []string {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/runs?metadata[model]=" + model + filter)
+		if err != nil {
+			t.Fatalf("GET /runs failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var res struct {
+			Runs []struct {
+				Name string `json:"name"`
+			} `json:"runs"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /runs%s: status %d, decode error %v", filter, resp.StatusCode, err)
+		}
+		var names []string
+		for _, run := range res.Runs {
+			names = append(names, run.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	for filter, want := range map[string][]string{
+		"":                              {"large", "small", "text"},
+		"&metadata[tokens]=5":           {"small"},
+		"&metadata[tokens][gte]=10":     {"large"},
+		"&metadata[tokens][lt]=10":      {"small"},
+		"&metadata[tokens][gt]=a":       {"text"},
+		"&metadata[user][exists]=true":  {"large"},
+		"&metadata[user][exists]=false": {"small", "text"},
+	} {
+		if got := list(filter); !slices.Equal(got, want) {
+			t.Errorf("filter %q: got %v, want %v", filter, got, want)
+		}
+	}
+}
+
+func TestRunTags(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	// A unique tag keeps earlier test data out of the listing.
+	label := "exp-" + uuid.NewString()
+	runs := []map[string]any{{"trace_id": uuid.NewString(), "name": "tagged", "tags": []string{label, "prod"}}}
+	body, _ := json.Marshal(runs)
+	runIDs := postRuns(t, ts, body)
+	if len(runIDs) != 1 {
+		t.Fatalf("POST /runs returned ids %v, want 1", runIDs)
+	}
+	runURL := ts.URL + "/runs/" + runIDs[0]
+
+	getRun := func() ([]string, string) {
+		t.Helper()
+		resp, err := http.Get(runURL)
+		if err != nil {
+			t.Fatalf("GET run failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var run struct {
+			Tags []string `json:"tags"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&run)
+		return run.Tags, resp.Header.Get("ETag")
+	}
+	tags, etag := getRun()
+	if !slices.Equal(tags, []string{label, "prod"}) {
+		t.Fatalf("tags after ingest = %v", tags)
+	}
+
+	resp, err := http.Post(runURL+"/tags", "application/json", strings.NewReader(`{"tags":["reviewed","prod","team/ml"]}`))
+	if err != nil {
+		t.Fatalf("POST tags failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST tags: status %d", resp.StatusCode)
+	}
+	// A tag containing "/" is addressed with its slash escaped.
+	for _, tag := range []string{"prod", "team%2Fml"} {
+		req, _ := http.NewRequest(http.MethodDelete, runURL+"/tags/"+tag, nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE tag %s failed: %v", tag, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("DELETE tag %s: status %d", tag, resp.StatusCode)
+		}
+	}
+	tags, newETag := getRun()
+	if !slices.Equal(tags, []string{label, "reviewed"}) {
+		t.Errorf("tags after update = %v", tags)
+	}
+	if newETag == etag {
+		t.Error("ETag did not change with the tags")
+	}
+
+	list, err := http.Get(ts.URL + "/runs?tag=" + label + "&tag=reviewed")
+	if err != nil {
+		t.Fatalf("GET /runs failed: %v", err)
+	}
+	var res struct {
+		Runs []struct {
+			ID string `json:"id"`
+		} `json:"runs"`
+	}
+	_ = json.NewDecoder(list.Body).Decode(&res)
+	list.Body.Close()
+	if len(res.Runs) != 1 || res.Runs[0].ID != runIDs[0] {
+		t.Errorf("tag filter returned %+v", res.Runs)
+	}
+}
+
+func TestRunFeedback(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	// A unique run name keeps earlier test data out of the stats.
+	name := "scored-" + uuid.NewString()
+	runs := []map[string]any{{"trace_id": uuid.NewString(), "name": name}, {"trace_id": uuid.NewString(), "name": name}}
+	body, _ := json.Marshal(runs)
+	runIDs := postRuns(t, ts, body)
+	if len(runIDs) != 2 {
+		t.Fatalf("POST /runs returned ids %v, want 2", runIDs)
+	}
+	runURL := ts.URL + "/runs/" + runIDs[0]
+
+	resp, err := http.Post(runURL+"/feedback", "application/json",
+		strings.NewReader(`{"key":"thumbs","score":1,"value":{"label":"up"},"comment":"good","source":"human"}`))
+	if err != nil {
+		t.Fatalf("POST feedback failed: %v", err)
+	}
+	var fb struct {
+		ID    string          `json:"id"`
+		Value json.RawMessage `json:"value"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&fb)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || fb.ID == "" {
+		t.Fatalf("POST feedback: status %d, %+v", resp.StatusCode, fb)
+	}
+
+	batch := fmt.Sprintf(`[{"run_id":%q,"key":"correctness","score":0.5},{"run_id":%q,"key":"correctness","score":1}]`,
+		runIDs[0], runIDs[1])
+	resp, err = http.Post(ts.URL+"/feedback", "application/json", strings.NewReader(batch))
+	if err != nil {
+		t.Fatalf("POST /feedback failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /feedback: status %d", resp.StatusCode)
+	}
+	missing := fmt.Sprintf(`[{"run_id":%q,"key":"correctness"}]`, uuid.NewString())
+	resp, err = http.Post(ts.URL+"/feedback", "application/json", strings.NewReader(missing))
+	if err != nil {
+		t.Fatalf("POST /feedback failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST /feedback for a missing run: status %d, want 404", resp.StatusCode)
+	}
+
+	listFeedback := func() []string {
+		t.Helper()
+		resp, err := http.Get(runURL + "/feedback")
+		if err != nil {
+			t.Fatalf("GET feedback failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var res struct {
+			Feedback []struct {
+				Key string `json:"key"`
+			} `json:"feedback"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		var keys []string
+		for _, f := range res.Feedback {
+			keys = append(keys, f.Key)
+		}
+		return keys
+	}
+	if keys := listFeedback(); !slices.Equal(keys, []string{"thumbs", "correctness"}) {
+		t.Errorf("feedback keys = %v", keys)
+	}
+
+	stats, err := http.Get(ts.URL + "/feedback/stats?key=correctness&group_by=run_name&bucket=day&run_name=" + name)
+	if err != nil {
+		t.Fatalf("GET /feedback/stats failed: %v", err)
+	}
+	var res struct {
+		Stats []struct {
+			RunName  string  `json:"run_name"`
+			Count    int     `json:"count"`
+			AvgScore float64 `json:"avg_score"`
+		} `json:"stats"`
+	}
+	_ = json.NewDecoder(stats.Body).Decode(&res)
+	stats.Body.Close()
+	if len(res.Stats) != 1 || res.Stats[0].RunName != name || res.Stats[0].Count != 2 || res.Stats[0].AvgScore != 0.75 {
+		t.Errorf("stats = %+v", res.Stats)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, runURL+"/feedback/"+fb.ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE feedback failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE feedback: status %d", resp.StatusCode)
+	}
+	if keys := listFeedback(); !slices.Equal(keys, []string{"correctness"}) {
+		t.Errorf("feedback keys after delete = %v", keys)
+	}
+}
+
+func TestCreateRunsIdempotencyKey(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	runs := []map[string]any{
+		{"trace_id": uuid.New().String(), "name": "Retry 1", "inputs": map[string]any{"a": 1}},
+		{"trace_id": uuid.New().String(), "name": "Retry 2", "outputs": map[string]any{"b": 2}},
+	}
+	body, _ := json.Marshal(runs)
+	key := uuid.New().String()
+
+	post := func() (ids, existing []string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/runs", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotencyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /runs failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status 201, got %d", resp.StatusCode)
+		}
+		var created struct {
+			RunIDs         []string `json:"run_ids"`
+			ExistingRunIDs []string `json:"existing_run_ids"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+			t.Fatalf("failed decoding response: %v", err)
+		}
+		return created.RunIDs, created.ExistingRunIDs
+	}
+
+	first, existing := post()
+	if len(first) != 2 || len(existing) != 0 {
+		t.Fatalf("first attempt: got run_ids=%v existing_run_ids=%v", first, existing)
+	}
+	// A tag added before the retry must survive it.
+	resp, err := http.Post(ts.URL+"/runs/"+first[0]+"/tags", "application/json", strings.NewReader(`{"tags":["reviewed"]}`))
+	if err != nil {
+		t.Fatalf("POST tags failed: %v", err)
+	}
+	resp.Body.Close()
+	getRun := func() (string, []string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/runs/" + first[0])
+		if err != nil {
+			t.Fatalf("GET run failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var run struct {
+			Tags []string `json:"tags"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&run)
+		return resp.Header.Get("ETag"), run.Tags
+	}
+	etag, _ := getRun()
+
+	second, existing := post()
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("retry returned different ids: %v vs %v", first, second)
+	}
+	if len(existing) != 2 {
+		t.Fatalf("retry should report both runs as existing, got %v", existing)
+	}
+	if newETag, tags := getRun(); newETag != etag || !slices.Equal(tags, []string{"reviewed"}) {
+		t.Errorf("retry changed the stored run: ETag %s -> %s, tags %v", etag, newETag, tags)
+	}
+}
+
+func TestCreateRunsMultipart(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	// Force the multipart path with the smallest part size so the batch spans several parts.
+	cfg := *srv.settings()
+	cfg.S3MultipartThreshold = 1
+	cfg.S3MultipartPartSize = minPartSize
+	srv.cfg.Store(&cfg)
+
+	const batch = 4
+	body := makeRunsBody(batch, 1500)
+	var sent []map[string]any
+	_ = json.Unmarshal(body, &sent)
+
+	runIDs := postRuns(t, ts, body)
+	if len(runIDs) != batch {
+		t.Fatalf("expected %d run_ids, got %d", batch, len(runIDs))
+	}
+
+	for i, id := range runIDs {
+		rresp, err := http.Get(ts.URL + "/runs/" + id)
+		if err != nil {
+			t.Fatalf("GET /runs/%s failed: %v", id, err)
+		}
+		var got map[string]any
+		if err := json.NewDecoder(rresp.Body).Decode(&got); err != nil {
+			t.Fatalf("decode get response: %v", err)
+		}
+		_ = rresp.Body.Close()
+		for _, field := range []string{"inputs", "outputs", "metadata"} {
+			if !reflect.DeepEqual(normalizeJSON(sent[i][field]), normalizeJSON(got[field])) {
+				t.Fatalf("run %d: %s mismatch after multipart upload", i, field)
+			}
+		}
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	r, srv := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer srv.db.Close()
+
+	resp, err := http.Get(ts.URL + "/livez")
+	if err != nil {
+		t.Fatalf("GET /livez failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected /livez 200, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/readyz")
+	if err != nil {
+		t.Fatalf("GET /readyz failed: %v", err)
+	}
+	var ready struct {
+		Status string                     `json:"status"`
+		Checks map[string]dependencyCheck `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+		t.Fatalf("decode /readyz: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || ready.Status != "ok" {
+		t.Fatalf("expected ready, got %d %+v", resp.StatusCode, ready)
+	}
+	for _, dep := range []string{"postgres", "s3", "migrations"} {
+		if ready.Checks[dep].Status != "ok" {
+			t.Fatalf("expected %s check ok, got %+v", dep, ready.Checks[dep])
+		}
+	}
+
+	srv.shuttingDown.Store(true)
+	resp, err = http.Get(ts.URL + "/readyz")
+	if err != nil {
+		t.Fatalf("GET /readyz failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected /readyz 503 during shutdown, got %d", resp.StatusCode)
+	}
+	resp, err = http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected /healthz 200 during shutdown, got %d", resp.StatusCode)
+	}
+}
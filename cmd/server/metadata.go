@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// metadataAttrs returns the top-level scalar values of a run's metadata that are
+// indexed for filtering, as a JSON object, or nil if there are none. Nested values,
+// nulls, strings longer than maxAttrValue and keys beyond the first maxAttrs (in key
+// order) are left out.
+func (ix indexer) metadataAttrs(metadata []byte) []byte {
+	metadata = bytes.TrimLeft(metadata, " \t\r\n")
+	if ix.maxAttrs <= 0 || len(metadata) == 0 || metadata[0] != '{' {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(metadata, &fields); err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if ix.attrKeys == nil || ix.attrKeys[k] {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	attrs := make(map[string]json.RawMessage, min(len(keys), ix.maxAttrs))
+	for _, k := range keys {
+		if len(attrs) == ix.maxAttrs {
+			break
+		}
+		if v := fields[k]; isIndexableScalar(v, ix.maxAttrValue) && !strings.ContainsRune(k, 0) {
+			attrs[k] = v
+		}
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(attrs)
+	return b
+}
+
+// isIndexableScalar reports whether v is a number, a boolean, or a string of at most
+// maxLen bytes that Postgres can store (jsonb rejects \u0000).
+func isIndexableScalar(v json.RawMessage, maxLen int) bool {
+	if len(v) == 0 {
+		return false
+	}
+	switch c := v[0]; {
+	case c == '"':
+		var s string
+		return json.Unmarshal(v, &s) == nil && len(s) <= maxLen && !strings.ContainsRune(s, 0)
+	case c == 't' || c == 'f':
+		return true
+	case c == '-' || (c >= '0' && c <= '9'):
+		return true
+	}
+	return false
+}
+
+// maxRunFilters bounds the filters of one listing request.
+const maxRunFilters = 20
+
+// metadataParamRe matches metadata[key] and metadata[key][op] query parameters.
+var metadataParamRe = regexp.MustCompile(`^metadata\[([^\]]+)\](?:\[(eq|gt|gte|lt|lte|exists)\])?$`)
+
+var rangeOps = map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+// sqlBuilder accumulates the conditions of a WHERE clause with numbered arguments.
+type sqlBuilder struct {
+	conds []string
+	args  []any
+}
+
+// arg adds v as the next argument and returns its placeholder.
+func (b *sqlBuilder) arg(v any) string {
+	b.args = append(b.args, v)
+	return "$" + strconv.Itoa(len(b.args))
+}
+
+// where returns the conditions joined with AND, or TRUE if there are none.
+func (b *sqlBuilder) where() string {
+	if len(b.conds) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(b.conds, " AND ")
+}
+
+// parseRunFilter turns the filter parameters of GET /runs into SQL:
+//
+//	trace_id=<uuid>
+//	tag=a&tag=b                  runs with all of these tags
+//	any_tag=a&any_tag=b          runs with at least one of these tags
+//	metadata[key]=value          equality, as a string or, if it parses, a number or boolean
+//	metadata[key][gt]=value      also gte, lt, lte; numeric if value is a number, else text
+//	metadata[key][exists]=bool   whether the key was indexed for the run
+//
+// Range comparisons cannot use the GIN index on metadata_attrs; they only narrow down
+// rows found by the other conditions or a scan. Other parameters are ignored so that the
+// caller can handle them.
+func parseRunFilter(q url.Values) (*sqlBuilder, error) {
+	f := &sqlBuilder{}
+	// Sorted so that the generated SQL, and with it the plan cache, is stable.
+	params := make([]string, 0, len(q))
+	for p := range q {
+		params = append(params, p)
+	}
+	slices.Sort(params)
+	n := 0
+	for _, p := range params {
+		for _, v := range q[p] {
+			if p == "tag" || p == "any_tag" {
+				continue // collected below, as one condition per parameter
+			}
+			if p == "trace_id" {
+				traceID, err := uuid.Parse(v)
+				if err != nil {
+					return nil, fmt.Errorf("trace_id must be a valid UUID")
+				}
+				f.conds = append(f.conds, "trace_id = "+f.arg(traceID))
+				n++
+				continue
+			}
+			m := metadataParamRe.FindStringSubmatch(p)
+			if m == nil {
+				continue
+			}
+			n++
+			key, op := m[1], m[2]
+			switch op {
+			case "", "eq":
+				alts := []string{"metadata_attrs @> " + f.arg(jsonObject(key, v))}
+				if json.Valid([]byte(v)) && v[0] != '"' && isIndexableScalar(json.RawMessage(v), 0) {
+					alts = append(alts, "metadata_attrs @> "+f.arg(jsonObject(key, json.RawMessage(v))))
+				}
+				f.conds = append(f.conds, "("+strings.Join(alts, " OR ")+")")
+			case "exists":
+				exists, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s must be true or false", p)
+				}
+				cond := "metadata_attrs ? " + f.arg(key)
+				if !exists {
+					cond = "NOT COALESCE(" + cond + ", false)"
+				}
+				f.conds = append(f.conds, cond)
+			default:
+				// Postgres may evaluate AND operands in any order, so the cast is guarded by
+				// CASE: values of another type yield NULL instead of a cast error.
+				k := f.arg(key)
+				if _, err := strconv.ParseFloat(v, 64); err == nil {
+					f.conds = append(f.conds, fmt.Sprintf("CASE WHEN jsonb_typeof(metadata_attrs -> %s) = 'number' THEN (metadata_attrs ->> %s)::numeric END %s %s::numeric", k, k, rangeOps[op], f.arg(v)))
+				} else {
+					f.conds = append(f.conds, fmt.Sprintf("CASE WHEN jsonb_typeof(metadata_attrs -> %s) = 'string' THEN metadata_attrs ->> %s END %s %s", k, k, rangeOps[op], f.arg(v)))
+				}
+			}
+		}
+	}
+	for _, tf := range []struct{ param, op string }{{"any_tag", "&&"}, {"tag", "@>"}} {
+		if len(q[tf.param]) > 0 {
+			// Stored tags are normalized, so the filter values must be too.
+			tags, err := normalizeTags(q[tf.param])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s filter: %v", tf.param, err)
+			}
+			f.conds = append(f.conds, "tags "+tf.op+" "+f.arg(tags)+"::text[]")
+			n += len(tags)
+		}
+	}
+	if n > maxRunFilters {
+		return nil, fmt.Errorf("at most %d filters are allowed", maxRunFilters)
+	}
+	return f, nil
+}
+
+// jsonObject renders {key: value} for a jsonb containment test.
+func jsonObject(key string, value any) string {
+	b, _ := json.Marshal(map[string]any{key: value})
+	return string(b)
+}
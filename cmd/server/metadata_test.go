@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestMetadataAttrs(t *testing.T) {
+	cfg := appconfig.Defaults()
+	cfg.MetadataAttrMaxValueBytes = 8
+	ix := newIndexer(&cfg)
+
+	meta := []byte(`{"model":"gpt-4","temperature":0.7,"tokens":42,"stream":true,
+		"nested":{"a":1},"list":[1],"none":null,"prompt":"far too long for the limit"}`)
+	got := string(ix.metadataAttrs(meta))
+	want := `{"model":"gpt-4","stream":true,"temperature":0.7,"tokens":42}`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	cfg.MetadataAttrKeys = "model, tokens"
+	if got := string(newIndexer(&cfg).metadataAttrs(meta)); got != `{"model":"gpt-4","tokens":42}` {
+		t.Errorf("allowlist: got %s", got)
+	}
+
+	cfg.MetadataAttrKeys = ""
+	cfg.MetadataAttrMaxKeys = 2
+	if got := string(newIndexer(&cfg).metadataAttrs(meta)); got != `{"model":"gpt-4","stream":true}` {
+		t.Errorf("max keys: got %s", got)
+	}
+
+	for _, meta := range []string{"", "{}", "null", `[1,2]`, `{"a":{"b":1}}`} {
+		if got := ix.metadataAttrs([]byte(meta)); got != nil {
+			t.Errorf("%q: got %s, want nil", meta, got)
+		}
+	}
+}
+
+func TestParseRunFilter(t *testing.T) {
+	q := url.Values{
+		"metadata[model]":        {"gpt-4"},
+		"metadata[tokens][gte]":  {"10"},
+		"metadata[day][lt]":      {"2025-01-01"},
+		"metadata[user][exists]": {"false"},
+		"metadata[stream][eq]":   {"true"},
+		"trace_id":               {"6f0b7d4e-2c1a-4f43-9a57-3f1f4c6b8e21"},
+		"tag":                    {" prod", "eval", "prod "},
+		"any_tag":                {"a", "b"},
+		"limit":                  {"5"},
+		"unrelated[param]":       {"x"},
+	}
+	f, err := parseRunFilter(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	where := f.where()
+	for _, want := range []string{
+		"CASE WHEN jsonb_typeof(metadata_attrs -> $1) = 'string' THEN metadata_attrs ->> $1 END < $2",
+		"metadata_attrs @> $3)",
+		"(metadata_attrs @> $4 OR metadata_attrs @> $5)",
+		"CASE WHEN jsonb_typeof(metadata_attrs -> $6) = 'number' THEN (metadata_attrs ->> $6)::numeric END >= $7::numeric",
+		"NOT COALESCE(metadata_attrs ? $8, false)",
+		"trace_id = $9",
+		"tags && $10::text[]",
+		"tags @> $11::text[]",
+	} {
+		if !strings.Contains(where, want) {
+			t.Errorf("WHERE clause lacks %q:\n%s", want, where)
+		}
+	}
+	if len(f.args) != 11 || f.args[2] != `{"model":"gpt-4"}` || f.args[3] != `{"stream":"true"}` || f.args[4] != `{"stream":true}` {
+		t.Errorf("unexpected args %q", f.args)
+	}
+	if tags, _ := f.args[10].([]string); !slices.Equal(tags, []string{"eval", "prod"}) {
+		t.Errorf("tag filter values not normalized: %q", f.args[10])
+	}
+
+	empty, err := parseRunFilter(url.Values{"limit": {"5"}})
+	if err != nil || empty.where() != "TRUE" {
+		t.Errorf("no filters: %q, %v", empty.where(), err)
+	}
+
+	for name, q := range map[string]url.Values{
+		"bad trace id": {"trace_id": {"nope"}},
+		"bad exists":   {"metadata[a][exists]": {"maybe"}},
+		"blank tag":    {"tag": {"  "}},
+		"too many":     {"metadata[a]": make([]string, maxRunFilters+1)},
+	} {
+		if _, err := parseRunFilter(q); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
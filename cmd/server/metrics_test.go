@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentHTTPUsesRoutePattern(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(instrumentHTTP)
+	r.Get("/things/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	counter := httpRequestsTotal.WithLabelValues("/things/{id}", http.MethodGet, "418")
+	before := testutil.ToFloat64(counter)
+	for _, id := range []string{"a", "b", "c"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/things/"+id, nil))
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Fatalf("expected 3 requests recorded under the route pattern, got %v", got)
+	}
+
+	unmatched := httpRequestsTotal.WithLabelValues("unmatched", http.MethodGet, "404")
+	before = testutil.ToFloat64(unmatched)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nope", nil))
+	if got := testutil.ToFloat64(unmatched) - before; got != 1 {
+		t.Fatalf("expected unmatched request to be recorded, got %v", got)
+	}
+}
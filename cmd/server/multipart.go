@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// minPartSize is the smallest part S3 accepts (except for the last one).
+	minPartSize = 5 * 1024 * 1024
+	// partUploadConcurrency bounds parts in flight, and with it the memory held per batch.
+	partUploadConcurrency = 4
+)
+
+// batchWriter is what buildBatch serializes into. Len reports the absolute number of
+// bytes written so far, which is what byte ranges in refs are measured against.
+type batchWriter interface {
+	Write(p []byte) (int, error)
+	WriteByte(c byte) error
+	WriteString(s string) (int, error)
+	Len() int
+}
+
+// multipartWriter streams a batch object to S3 as a multipart upload, shipping each
+// part as soon as it is full. Upload errors are sticky and reported by complete.
+type multipartWriter struct {
+	ctx      context.Context
+	s3       *s3.Client
+	bucket   string
+	key      string
+	uploadID *string
+	partSize int
+
+	part    bytes.Buffer
+	flushed int // bytes already handed off in earlier parts
+	partNum int32
+	g       *errgroup.Group
+
+	mu    sync.Mutex
+	parts []types.CompletedPart
+}
+
+// newMultipartWriter starts a multipart upload for bucket/key.
+func newMultipartWriter(ctx context.Context, client *s3.Client, bucket, key string, partSize int) (*multipartWriter, error) {
+	out, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 create multipart upload: %w", err)
+	}
+	partSize = max(partSize, minPartSize)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(partUploadConcurrency)
+	mw := &multipartWriter{ctx: gctx, s3: client, bucket: bucket, key: key, uploadID: out.UploadId, partSize: partSize, g: g}
+	mw.part.Grow(partSize)
+	return mw, nil
+}
+
+func (mw *multipartWriter) Len() int { return mw.flushed + mw.part.Len() }
+
+func (mw *multipartWriter) Write(p []byte) (int, error) {
+	n, _ := mw.part.Write(p)
+	mw.maybeShip()
+	return n, nil
+}
+
+func (mw *multipartWriter) WriteByte(c byte) error {
+	_ = mw.part.WriteByte(c)
+	mw.maybeShip()
+	return nil
+}
+
+func (mw *multipartWriter) WriteString(s string) (int, error) {
+	n, _ := mw.part.WriteString(s)
+	mw.maybeShip()
+	return n, nil
+}
+
+func (mw *multipartWriter) maybeShip() {
+	if mw.part.Len() >= mw.partSize {
+		mw.ship()
+	}
+}
+
+// ship hands the buffered bytes off as the next part.
+func (mw *multipartWriter) ship() {
+	mw.partNum++
+	num := mw.partNum
+	data := bytes.Clone(mw.part.Bytes())
+	offset := mw.flushed
+	mw.flushed += len(data)
+	mw.part.Reset()
+	mw.g.Go(func() error {
+		ctx, span := tracer.Start(mw.ctx, "s3.UploadPart", s3ObjectAttrs(mw.bucket, mw.key, offset, offset+len(data)))
+		start := time.Now()
+		out, err := mw.s3.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(mw.bucket),
+			Key:        aws.String(mw.key),
+			UploadId:   mw.uploadID,
+			PartNumber: aws.Int32(num),
+			Body:       bytes.NewReader(data),
+		})
+		observeS3("UploadPart", start, err)
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("s3 upload part %d: %w", num, err)
+		}
+		s3BytesWrittenTotal.Add(float64(len(data)))
+		mw.mu.Lock()
+		mw.parts = append(mw.parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(num)})
+		mw.mu.Unlock()
+		return nil
+	})
+}
+
+// complete uploads the final part and assembles the object. On failure the upload is aborted.
+// An empty upload still gets one (empty) part, since S3 requires at least one.
+func (mw *multipartWriter) complete(ctx context.Context) error {
+	if mw.part.Len() > 0 || mw.partNum == 0 {
+		mw.ship()
+	}
+	if err := mw.g.Wait(); err != nil {
+		mw.abort(ctx)
+		return err
+	}
+	mw.mu.Lock()
+	parts := mw.parts
+	mw.mu.Unlock()
+	slices.SortFunc(parts, func(a, b types.CompletedPart) int { return int(*a.PartNumber - *b.PartNumber) })
+	start := time.Now()
+	_, err := mw.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(mw.bucket),
+		Key:             aws.String(mw.key),
+		UploadId:        mw.uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	observeS3("CompleteMultipartUpload", start, err)
+	if err != nil {
+		mw.abort(ctx)
+		return fmt.Errorf("s3 complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+// abort discards the upload and any parts already stored.
+func (mw *multipartWriter) abort(ctx context.Context) {
+	_ = mw.g.Wait()
+	_, err := mw.s3.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(mw.bucket),
+		Key:      aws.String(mw.key),
+		UploadId: mw.uploadID,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "s3 abort multipart upload failed", "batch_key", mw.key, "error", err)
+	}
+}
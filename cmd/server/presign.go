@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/goccy/go-json"
+)
+
+// presignedField replaces a large field's JSON when the client asks for presigned URLs.
+// Range is signed into the URL, so the client must send it as the Range header; the URL
+// grants access to that field only, not to the rest of the batch object.
+type presignedField struct {
+	URL       string    `json:"url"`
+	Range     string    `json:"range"`
+	Bytes     int       `json:"bytes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// presignField returns the JSON of a presignedField for bytes [start, end) of an object.
+func (s *Server) presignField(ctx context.Context, bucket, key string, start, end int, ttl time.Duration) ([]byte, error) {
+	rng := fmt.Sprintf("bytes=%d-%d", start, end-1)
+	expires := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	req, err := s3.NewPresignClient(s.s3).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(rng),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("presign %s: %w", key, err)
+	}
+	return json.Marshal(presignedField{URL: req.URL, Range: rng, Bytes: end - start, ExpiresAt: expires})
+}
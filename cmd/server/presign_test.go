@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestPresignFieldSignsRange(t *testing.T) {
+	settings := appconfig.Defaults()
+	settings.S3AccessKey, settings.S3SecretKey = "id", "secret"
+	client, err := newS3Client(context.Background(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{s3: client}
+
+	raw, err := srv.presignField(context.Background(), "runs", "batches/a.json", 100, 200, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f presignedField
+	if err := json.Unmarshal(raw, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Range != "bytes=100-199" || f.Bytes != 100 {
+		t.Errorf("range=%q bytes=%d, want bytes=100-199 and 100", f.Range, f.Bytes)
+	}
+	if until := time.Until(f.ExpiresAt); until <= 0 || until > time.Minute {
+		t.Errorf("expires_at %s is not within the TTL", f.ExpiresAt)
+	}
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if !strings.HasSuffix(u.Path, "/runs/batches/a.json") || q.Get("X-Amz-Expires") != "60" {
+		t.Errorf("unexpected URL %s", f.URL)
+	}
+	if !strings.Contains(q.Get("X-Amz-SignedHeaders"), "range") {
+		t.Errorf("range is not a signed header: %q", q.Get("X-Amz-SignedHeaders"))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/langchain-ai/ls-go-run-handler/internal/migrate"
+	"github.com/langchain-ai/ls-go-run-handler/migrations"
+)
+
+// embeddedMigrations are the migrations compiled into this binary.
+var embeddedMigrations = mustLoadMigrations()
+
+func mustLoadMigrations() []migrate.Migration {
+	migs, err := migrate.Load(migrations.FS)
+	if err != nil {
+		panic(err)
+	}
+	return migs
+}
+
+// expectedSchemaVersion is the newest migration this binary relies on.
+func expectedSchemaVersion() int64 {
+	return migrate.Latest(embeddedMigrations)
+}
+
+// applyMigrations brings the schema up to date. Concurrent replicas wait on each other.
+func applyMigrations(ctx context.Context, db *pgxpool.Pool) error {
+	n, err := migrate.New(db, embeddedMigrations).Up(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		slog.Info("applied migrations", "count", n, "version", expectedSchemaVersion())
+	}
+	return nil
+}
+
+// ensureBucket creates the configured bucket if it does not exist yet.
+func ensureBucket(ctx context.Context, client *s3.Client, bucket string) error {
+	_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		return nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("head bucket %s: %w", bucket, err)
+	}
+	_, err = client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	var owned *types.BucketAlreadyOwnedByYou
+	if err != nil && !errors.As(err, &owned) {
+		return fmt.Errorf("create bucket %s: %w", bucket, err)
+	}
+	slog.Info("created bucket", "bucket", bucket)
+	return nil
+}
+
+// runMigrateCommand implements `server migrate [up | down [N] | version]`.
+func runMigrateCommand(ctx context.Context, db *pgxpool.Pool, args []string) error {
+	m := migrate.New(db, embeddedMigrations)
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migrations\n", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+		}
+		n, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reverted %d migrations\n", n)
+	case "version":
+		version, dirty, err := m.Version(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("version %d (latest %d, dirty=%t)\n", version, expectedSchemaVersion(), dirty)
+	default:
+		return fmt.Errorf("unknown migrate action %q (want up, down [N] or version)", action)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/langchain-ai/ls-go-run-handler/internal/lru"
+)
+
+// rangeCache keeps recently read field ranges of batch objects in memory. Batch objects
+// are never rewritten, so entries need no invalidation. Concurrent misses for the same
+// range share one GetObject.
+type rangeCache struct {
+	cache    *lru.Cache
+	maxEntry int
+	group    singleflight.Group
+}
+
+func newRangeCache(maxBytes, maxEntry int) *rangeCache {
+	return &rangeCache{cache: lru.New(int64(maxBytes)), maxEntry: maxEntry}
+}
+
+// cacheable reports whether a range of n bytes goes through the cache; larger ones are
+// streamed so that one huge field cannot flush everything else out.
+func (rc *rangeCache) cacheable(n int) bool {
+	return rc != nil && n <= rc.maxEntry
+}
+
+// get returns the cached bytes for key, or loads them with fetch. The shared fetch is
+// not cancelled when one waiting caller gives up; ctx only bounds this caller's wait.
+func (rc *rangeCache) get(ctx context.Context, key string, fetch func(context.Context) ([]byte, error)) ([]byte, error) {
+	if b, ok := rc.cache.Get(key); ok {
+		rangeCacheRequestsTotal.WithLabelValues("hit").Inc()
+		return b, nil
+	}
+	ran := false
+	ch := rc.group.DoChan(key, func() (any, error) {
+		ran = true
+		b, err := fetch(context.WithoutCancel(ctx))
+		if err == nil {
+			rc.cache.Add(key, b)
+		}
+		return b, err
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if ran {
+			rangeCacheRequestsTotal.WithLabelValues("miss").Inc()
+		} else {
+			rangeCacheRequestsTotal.WithLabelValues("shared").Inc()
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	}
+}
+
+// sizeGauge exports the bytes held by the cache.
+func (rc *rangeCache) sizeGauge() prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "range_cache_bytes",
+		Help:      "Bytes of S3 ranges held in the in-process cache.",
+	}, func() float64 { return float64(rc.cache.Size()) })
+}
+
+// readS3Range reads bytes [start, end) of an object in full.
+func (s *Server) readS3Range(ctx context.Context, bucket, key string, start, end int) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "s3.GetRange", s3ObjectAttrs(bucket, key, start, end))
+	began := time.Now()
+	out, err := s.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+	})
+	if err == nil {
+		b := make([]byte, end-start)
+		_, err = io.ReadFull(out.Body, b)
+		_ = out.Body.Close()
+		if err == nil {
+			observeS3("GetObject", began, nil)
+			endSpan(span, nil)
+			return b, nil
+		}
+	}
+	observeS3("GetObject", began, err)
+	endSpan(span, err)
+	return nil, err
+}
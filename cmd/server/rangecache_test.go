@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRangeCacheSharesMisses(t *testing.T) {
+	rc := newRangeCache(1<<20, 1024)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fetch := func(context.Context) ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte(`{"a":1}`), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := rc.get(context.Background(), "runs/k#0:7", fetch)
+			if err != nil || !bytes.Equal(b, []byte(`{"a":1}`)) {
+				t.Errorf("get = %q, %v", b, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if _, err := rc.get(context.Background(), "runs/k#0:7", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fetch ran %d times, want 1", n)
+	}
+}
+
+func TestRangeCacheErrorsAreNotCached(t *testing.T) {
+	rc := newRangeCache(1<<20, 1024)
+	boom := errors.New("boom")
+	if _, err := rc.get(context.Background(), "k", func(context.Context) ([]byte, error) { return nil, boom }); !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want boom", err)
+	}
+	b, err := rc.get(context.Background(), "k", func(context.Context) ([]byte, error) { return []byte("ok"), nil })
+	if err != nil || string(b) != "ok" {
+		t.Fatalf("get after error = %q, %v", b, err)
+	}
+}
+
+func TestRangeCacheCallerCancel(t *testing.T) {
+	rc := newRangeCache(1<<20, 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := rc.get(ctx, "k", func(fetchCtx context.Context) ([]byte, error) {
+			<-release
+			if fetchCtx.Err() != nil {
+				t.Error("shared fetch was cancelled with its caller")
+			}
+			return []byte("v"), nil
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want context.Canceled", err)
+		}
+	}()
+	cancel()
+	<-done
+	close(release)
+
+	// The fetch still completes and fills the cache for later callers.
+	b, err := rc.get(context.Background(), "k", func(context.Context) ([]byte, error) { return nil, errors.New("refetched") })
+	if err != nil || string(b) != "v" {
+		t.Errorf("get = %q, %v", b, err)
+	}
+}
+
+func TestRangeCacheCacheable(t *testing.T) {
+	var disabled *rangeCache
+	if disabled.cacheable(1) {
+		t.Error("nil cache should not be cacheable")
+	}
+	rc := newRangeCache(1<<20, 100)
+	if !rc.cacheable(100) || rc.cacheable(101) {
+		t.Error("cacheable should honour the max entry size")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+// watchConfig reloads the settings on SIGHUP and whenever the config file changes,
+// until ctx is done. args are the command-line arguments the settings were loaded with.
+func (s *Server) watchConfig(ctx context.Context, args []string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	cfg := s.settings()
+	var tick <-chan time.Time
+	if cfg.ConfigFile != "" && cfg.ConfigReloadInterval > 0 {
+		t := time.NewTicker(cfg.ConfigReloadInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	last := fileVersion(cfg.ConfigFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("config reload requested", "trigger", "SIGHUP")
+			last = fileVersion(cfg.ConfigFile)
+			s.reloadConfig(args)
+		case <-tick:
+			if v := fileVersion(cfg.ConfigFile); v != last {
+				last = v
+				slog.Info("config reload requested", "trigger", "file change", "path", cfg.ConfigFile)
+				s.reloadConfig(args)
+			}
+		}
+	}
+}
+
+// fileVersion identifies the current contents of path cheaply, by size and mtime.
+func fileVersion(path string) string {
+	if path == "" {
+		return ""
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%d/%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// reloadConfig loads and validates the settings again and applies the reloadable ones.
+// An invalid configuration is rejected as a whole and the running settings are kept.
+func (s *Server) reloadConfig(args []string) {
+	next, _, err := appconfig.Load(args)
+	if err != nil {
+		configReloadsTotal.WithLabelValues("rejected").Inc()
+		slog.Error("config reload rejected, keeping current settings", "error", err)
+		return
+	}
+	cur := s.settings()
+	changes := cur.Diff(next)
+	applied := 0
+	for _, c := range changes {
+		if c.Reloadable {
+			applied++
+			slog.Info("config changed", "key", c.Key, "old", c.Old, "new", c.New)
+		} else {
+			slog.Warn("config change needs a restart, ignored", "key", c.Key, "old", c.Old, "new", c.New)
+		}
+	}
+	configReloadsTotal.WithLabelValues("applied").Inc()
+	if applied == 0 {
+		slog.Info("config reloaded, nothing to apply")
+		return
+	}
+	s.applySettings(cur.WithReloadable(next))
+}
+
+// applySettings publishes cfg to request handlers and pushes it into the components
+// that keep their own copy.
+func (s *Server) applySettings(cfg appconfig.Settings) {
+	if lvl, err := parseLogLevel(cfg.LogLevel); err == nil {
+		logLevel.Set(lvl)
+	}
+	s.coalescer.setLimits(cfg.CoalesceWindow, cfg.CoalesceMaxRuns, cfg.CoalesceMaxBytes)
+	s.cfg.Store(&cfg)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(body string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("log_level: info\nport: 8000\n")
+	t.Setenv(appconfig.ConfigFileEnv, path)
+	cfg, _, err := appconfig.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logLevel.Set(logLevel.Level())
+	srv := newServer(cfg, nil, nil)
+
+	write("log_level: debug\nport: 9000\ncoalesce_window: 5ms\n")
+	srv.reloadConfig(nil)
+	got := srv.settings()
+	if got.LogLevel != "debug" || logLevel.Level() != slog.LevelDebug {
+		t.Errorf("log level not applied: settings=%q level=%s", got.LogLevel, logLevel.Level())
+	}
+	if got.CoalesceWindow != 5*time.Millisecond || !srv.coalescer.accepts(1, 1) {
+		t.Errorf("coalesce window not applied: %s", got.CoalesceWindow)
+	}
+	if got.Port != 8000 {
+		t.Errorf("port is not reloadable but changed to %d", got.Port)
+	}
+
+	write("log_level: loud\n")
+	srv.reloadConfig(nil)
+	if srv.settings() != got {
+		t.Error("invalid config should be rejected without touching the settings")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/sync/errgroup"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// extractSearchText collects the string values of JSON documents, but not their object
+// keys, one per line, up to limit bytes in total. Each document gets an equal share of
+// what is left, so large inputs cannot crowd out the outputs. Documents may be cut
+// short; scanning simply stops at the end.
+func extractSearchText(limit int, docs ...[]byte) string {
+	var sb strings.Builder
+	for d, doc := range docs {
+		budget := sb.Len() + (limit-sb.Len())/(len(docs)-d)
+		for i := 0; i < len(doc) && sb.Len() < budget; i++ {
+			if doc[i] != '"' {
+				continue
+			}
+			j, escaped := i+1, false
+			for ; j < len(doc) && doc[j] != '"'; j++ {
+				if doc[j] == '\\' {
+					escaped = true
+					j++
+				}
+			}
+			if j >= len(doc) {
+				break
+			}
+			raw := doc[i : j+1]
+			i = j
+			// A string followed by a colon is an object key.
+			k := j + 1
+			for k < len(doc) && (doc[k] == ' ' || doc[k] == '\t' || doc[k] == '\n' || doc[k] == '\r') {
+				k++
+			}
+			if k < len(doc) && doc[k] == ':' {
+				continue
+			}
+			s := string(raw[1 : len(raw)-1])
+			if escaped {
+				if err := json.Unmarshal(raw, &s); err != nil {
+					continue
+				}
+				// Postgres text cannot hold NUL.
+				s = strings.ReplaceAll(s, "\x00", "")
+			}
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('\n')
+			}
+			sb.WriteString(s[:min(len(s), max(budget-sb.Len(), 0))])
+		}
+	}
+	// Cutting a value short can split a multi-byte character.
+	return strings.ToValidUTF8(sb.String(), "")
+}
+
+// pageParams reads the limit and offset query parameters of a paginated listing.
+func pageParams(r *http.Request) (limit, offset int, err error) {
+	q := r.URL.Query()
+	limit = defaultPageLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// searchResult is one hit of GET /runs/search.
+type searchResult struct {
+	ID      uuid.UUID `json:"id"`
+	TraceID uuid.UUID `json:"trace_id"`
+	Name    string    `json:"name"`
+	Rank    float32   `json:"rank"`
+	Snippet string    `json:"snippet"`
+}
+
+// searchRunsHandler runs a full-text query over run names and the text indexed from
+// their inputs and outputs, best matches first. q uses web search syntax: quoted
+// phrases, OR, and -word to exclude.
+func (s *Server) searchRunsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := r.Context()
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "q is required"})
+		return
+	}
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	queryCtx, span := tracer.Start(ctx, "searchRuns.query")
+	// One extra row tells whether there is a next page.
+	rows, err := s.db.Query(queryCtx,
+		`SELECT id, trace_id, name, ts_rank_cd(search_vector, q) AS rank,
+		        ts_headline('english', COALESCE(search_text, ''), q, 'MaxFragments=2, MaxWords=20, MinWords=5')
+		 FROM runs, websearch_to_tsquery('english', $1) AS q
+		 WHERE search_vector @@ q
+		 ORDER BY rank DESC, id
+		 LIMIT $2 OFFSET $3`, query, limit+1, offset)
+	results := make([]searchResult, 0, limit+1)
+	if err == nil {
+		for rows.Next() {
+			var res searchResult
+			if err = rows.Scan(&res.ID, &res.TraceID, &res.Name, &res.Rank, &res.Snippet); err != nil {
+				break
+			}
+			results = append(results, res)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "search failed"})
+		return
+	}
+
+	resp := struct {
+		Runs       []searchResult `json:"runs"`
+		NextOffset *int           `json:"next_offset"`
+	}{Runs: results}
+	if len(results) > limit {
+		resp.Runs = results[:limit]
+		next := offset + limit
+		resp.NextOffset = &next
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// runSearchCommand implements `server search backfill [--all] [--batch N]`, which
+// indexes runs stored before search existed (or with indexing disabled) by reading
+// their inputs and outputs back from S3. --all reindexes every run.
+func runSearchCommand(ctx context.Context, settings appconfig.Settings, s3Client *s3.Client, db *pgxpool.Pool, args []string) error {
+	if len(args) == 0 || args[0] != "backfill" {
+		return fmt.Errorf("usage: search backfill [--all] [--batch N]")
+	}
+	fs := flag.NewFlagSet("search backfill", flag.ContinueOnError)
+	all := fs.Bool("all", false, "reindex runs that are already indexed")
+	batch := fs.Int("batch", 500, "runs read per page")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if settings.SearchTextBytes == 0 {
+		return fmt.Errorf("search indexing is disabled (SEARCH_TEXT_BYTES=0)")
+	}
+	srv := newServer(settings, s3Client, db)
+	where := "search_text IS NULL AND id > $1"
+	if *all {
+		where = "id > $1"
+	}
+
+	var after uuid.UUID
+	total := 0
+	for {
+		type pending struct {
+			id              uuid.UUID
+			inputs, outputs string
+		}
+		rows, err := db.Query(ctx,
+			`SELECT id, COALESCE(inputs, ''), COALESCE(outputs, '') FROM runs WHERE `+where+` ORDER BY id LIMIT $2`,
+			after, *batch)
+		if err != nil {
+			return fmt.Errorf("list runs: %w", err)
+		}
+		var page []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.id, &p.inputs, &p.outputs); err != nil {
+				rows.Close()
+				return fmt.Errorf("list runs: %w", err)
+			}
+			page = append(page, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("list runs: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(8)
+		for _, p := range page {
+			g.Go(func() error {
+				inputs, err := srv.readSearchField(gctx, p.inputs)
+				if err != nil {
+					return fmt.Errorf("run %s inputs: %w", p.id, err)
+				}
+				outputs, err := srv.readSearchField(gctx, p.outputs)
+				if err != nil {
+					return fmt.Errorf("run %s outputs: %w", p.id, err)
+				}
+				text := extractSearchText(settings.SearchTextBytes, inputs, outputs)
+				if _, err := db.Exec(gctx, `UPDATE runs SET search_text = $2 WHERE id = $1`, p.id, text); err != nil {
+					return fmt.Errorf("run %s: %w", p.id, err)
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		after = page[len(page)-1].id
+		total += len(page)
+		fmt.Printf("indexed %d runs\n", total)
+	}
+	fmt.Printf("backfill complete: %d runs indexed\n", total)
+	return nil
+}
+
+// readSearchField reads the start of the field at ref for indexing. Text is taken from
+// the beginning of each field, so a prefix a few times the text budget is enough and
+// keeps huge fields from being downloaded whole.
+func (s *Server) readSearchField(ctx context.Context, ref string) ([]byte, error) {
+	bucket, key, start, end, ok := s.parseS3Ref(ref)
+	if !ok || bucket == "" || key == "" || end <= start {
+		return nil, nil
+	}
+	end = min(end, start+16*s.settings().SearchTextBytes)
+	return s.readS3Range(ctx, bucket, key, start, end)
+}
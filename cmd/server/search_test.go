@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestExtractSearchText(t *testing.T) {
+	inputs := []byte(`{"question": "What is the capital of France?", "history": ["hi", ""], "n": 3}`)
+	outputs := []byte(`{"answer":"Paris été \"quoted\"","tokens":{"total":12}}`)
+	got := extractSearchText(1024, inputs, outputs)
+	want := "What is the capital of France?\nhi\nParis été \"quoted\""
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Large inputs cannot crowd out the outputs.
+	big := []byte(`{"text":"` + strings.Repeat("a", 1000) + `"}`)
+	got = extractSearchText(100, big, []byte(`["needle"]`))
+	if !strings.HasSuffix(got, "needle") || len(got) > 100 {
+		t.Errorf("outputs crowded out or limit exceeded: %d bytes %q", len(got), got)
+	}
+
+	// Truncation never leaves a split character behind.
+	got = extractSearchText(5, []byte(`["ééé"]`))
+	if !utf8.ValidString(got) || len(got) > 5 {
+		t.Errorf("truncated text %q is invalid or too long", got)
+	}
+
+	// Documents cut short, as the backfill reads them, are scanned up to the cut.
+	if got := extractSearchText(100, []byte(`{"a":"complete","b":"cut sh`)); got != "complete" {
+		t.Errorf("got %q from a truncated document", got)
+	}
+	if got := extractSearchText(100, nil, []byte(`{}`)); got != "" {
+		t.Errorf("got %q from empty documents", got)
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	for query, want := range map[string][2]int{
+		"":                   {defaultPageLimit, 0},
+		"?limit=5&offset=10": {5, 10},
+		"?limit=100":         {100, 0},
+	} {
+		limit, offset, err := pageParams(httptest.NewRequest("GET", "/runs/search"+query, nil))
+		if err != nil || limit != want[0] || offset != want[1] {
+			t.Errorf("%q: got %d, %d, %v; want %v", query, limit, offset, err, want)
+		}
+	}
+	for _, query := range []string{"?limit=0", "?limit=101", "?limit=x", "?offset=-1"} {
+		if _, _, err := pageParams(httptest.NewRequest("GET", "/runs/search"+query, nil)); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+// readSecretFile returns the contents of a mounted secret without surrounding whitespace,
+// so files written with a trailing newline work.
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read secret: %w", err)
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return v, nil
+}
+
+// fileCredentialsProvider reads S3 keys from files. The credentials it returns expire
+// after ttl, so a credentials cache re-reads the files and picks up rotated keys.
+type fileCredentialsProvider struct {
+	accessKeyFile, secretKeyFile string
+	ttl                          time.Duration
+}
+
+func (p fileCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	id, err := readSecretFile(p.accessKeyFile)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	secret, err := readSecretFile(p.secretKeyFile)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	return aws.Credentials{
+		AccessKeyID:     id,
+		SecretAccessKey: secret,
+		Source:          "SecretFiles",
+		CanExpire:       true,
+		Expires:         time.Now().Add(p.ttl),
+	}, nil
+}
+
+// s3CredentialsProvider picks the S3 credentials: key files, static keys, or nil to
+// fall back to the default AWS credential chain.
+func s3CredentialsProvider(settings appconfig.Settings) aws.CredentialsProvider {
+	switch {
+	case settings.S3AccessKeyFile != "":
+		return aws.NewCredentialsCache(fileCredentialsProvider{
+			accessKeyFile: settings.S3AccessKeyFile,
+			secretKeyFile: settings.S3SecretKeyFile,
+			ttl:           settings.CredentialsRefreshInterval,
+		})
+	case settings.S3AccessKey != "":
+		return credentials.NewStaticCredentialsProvider(settings.S3AccessKey, settings.S3SecretKey, "")
+	default:
+		return nil
+	}
+}
+
+// newS3Client builds the S3 client for settings, talking to S3Endpoint (MinIO locally)
+// when one is configured.
+func newS3Client(ctx context.Context, settings appconfig.Settings) (*s3.Client, error) {
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(settings.S3Region)}
+	if p := s3CredentialsProvider(settings); p != nil {
+		opts = append(opts, awsconfig.WithCredentialsProvider(p))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = true
+		if settings.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(settings.S3Endpoint)
+		}
+	}), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func writeSecret(t *testing.T, dir, name, value string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestS3CredentialsFromFilesRefresh(t *testing.T) {
+	dir := t.TempDir()
+	settings := appconfig.Defaults()
+	settings.S3AccessKeyFile = writeSecret(t, dir, "access", "id-1\n")
+	settings.S3SecretKeyFile = writeSecret(t, dir, "secret", "secret-1\n")
+	settings.CredentialsRefreshInterval = 10 * time.Millisecond
+
+	p := s3CredentialsProvider(settings)
+	creds, err := p.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "id-1" || creds.SecretAccessKey != "secret-1" {
+		t.Fatalf("got %q/%q", creds.AccessKeyID, creds.SecretAccessKey)
+	}
+
+	writeSecret(t, dir, "access", "id-2")
+	writeSecret(t, dir, "secret", "secret-2")
+	time.Sleep(20 * time.Millisecond)
+	creds, err = p.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "id-2" || creds.SecretAccessKey != "secret-2" {
+		t.Fatalf("rotated keys not picked up, got %q/%q", creds.AccessKeyID, creds.SecretAccessKey)
+	}
+}
+
+func TestS3CredentialsDefaultChain(t *testing.T) {
+	settings := appconfig.Defaults()
+	if p := s3CredentialsProvider(settings); p != nil {
+		t.Fatalf("expected the default chain without keys, got %T", p)
+	}
+}
+
+func TestPoolConfigPasswordFile(t *testing.T) {
+	settings := appconfig.Defaults()
+	path := writeSecret(t, t.TempDir(), "db", "s3cret\n")
+	settings.DBPasswordFile = path
+
+	cfg, err := newPoolConfig(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BeforeConnect == nil {
+		t.Fatal("expected a BeforeConnect hook")
+	}
+	cc := cfg.ConnConfig.Copy()
+	if err := cfg.BeforeConnect(context.Background(), cc); err != nil {
+		t.Fatal(err)
+	}
+	if cc.Password != "s3cret" {
+		t.Fatalf("password = %q", cc.Password)
+	}
+
+	writeSecret(t, filepath.Dir(path), "db", "")
+	if err := cfg.BeforeConnect(context.Background(), &pgx.ConnConfig{}); err == nil {
+		t.Fatal("expected an error for an empty secret file")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// maxTagsPerRun bounds the tags of one run, at ingest and after updates.
+	maxTagsPerRun = 64
+	// maxTagLen bounds the length of one tag in bytes.
+	maxTagLen = 128
+)
+
+// normalizeTags trims, de-duplicates and sorts tags. It never returns nil, so that the
+// result can be stored in the NOT NULL tags column as it is.
+func normalizeTags(tags []string) ([]string, error) {
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "":
+			return nil, errors.New("tags must not be empty")
+		case len(tag) > maxTagLen:
+			return nil, fmt.Errorf("tag %q is longer than %d bytes", tag[:16]+"...", maxTagLen)
+		case !utf8.ValidString(tag) || strings.ContainsFunc(tag, unicode.IsControl):
+			return nil, fmt.Errorf("tag %q contains invalid characters", tag)
+		}
+		out = append(out, tag)
+	}
+	slices.Sort(out)
+	out = slices.Compact(out)
+	if len(out) > maxTagsPerRun {
+		return nil, fmt.Errorf("a run may have at most %d tags", maxTagsPerRun)
+	}
+	return out, nil
+}
+
+// addTagsHandler implements POST /runs/{id}/tags, which adds {"tags": [...]} to a stored
+// run and returns the run's tags.
+func (s *Server) addTagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "body must be {\"tags\": [...]}"})
+		return
+	}
+	add, err := normalizeTags(req.Tags)
+	if err == nil && len(add) == 0 {
+		err = errors.New("tags must not be empty")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	s.updateTags(w, r, func(tags []string) ([]string, error) {
+		return normalizeTags(append(tags, add...))
+	})
+}
+
+// removeTagHandler implements DELETE /runs/{id}/tags/{tag} and returns the run's tags.
+// Tags containing "/" are addressed with it escaped as %2F. Removing a tag the run does
+// not have is not an error.
+func (s *Server) removeTagHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tag := chi.URLParam(r, "tag")
+	// chi routes on the escaped path when the URL has one, and the parameter is then
+	// still escaped.
+	var err error
+	if r.URL.RawPath != "" {
+		tag, err = url.PathUnescape(tag)
+	}
+	var norm []string
+	if err == nil {
+		norm, err = normalizeTags([]string{tag})
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid tag: " + err.Error()})
+		return
+	}
+	tag = norm[0]
+	s.updateTags(w, r, func(tags []string) ([]string, error) {
+		return slices.DeleteFunc(tags, func(t string) bool { return t == tag }), nil
+	})
+}
+
+// updateTags applies change to the tags of the run named in the URL, holding the row
+// lock so that concurrent updates do not lose each other's tags, and writes the result.
+func (s *Server) updateTags(w http.ResponseWriter, r *http.Request, change func([]string) ([]string, error)) {
+	ctx := r.Context()
+	idStr := chi.URLParam(r, "id")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "id must be a valid UUID"})
+		return
+	}
+	if s.queue != nil {
+		if _, ok := s.queue.lookup(id); ok {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "run is still being ingested; retry shortly"})
+			return
+		}
+	}
+
+	ctx, span := tracer.Start(ctx, "db.updateTags")
+	var tags []string
+	var rejected error
+	err = pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, `SELECT tags FROM runs WHERE id = $1 FOR UPDATE`, id).Scan(&tags); err != nil {
+			return err
+		}
+		if tags, rejected = change(tags); rejected != nil {
+			return rejected
+		}
+		_, err := tx.Exec(ctx, `UPDATE runs SET tags = $2 WHERE id = $1`, id, tags)
+		return err
+	})
+	endSpan(span, err)
+	switch {
+	case rejected != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": rejected.Error()})
+	case errors.Is(err, pgx.ErrNoRows):
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Run with ID %s not found", idStr)})
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "failed to update tags"})
+	default:
+		_ = json.NewEncoder(w).Encode(map[string][]string{"tags": tags})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	appconfig "github.com/langchain-ai/ls-go-run-handler/internal/config"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	got, err := normalizeTags([]string{" prod", "experiment-42", "prod", "b"})
+	if err != nil || !slices.Equal(got, []string{"b", "experiment-42", "prod"}) {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if got, err := normalizeTags(nil); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("nil tags: got %#v, %v; want an empty, non-nil slice", got, err)
+	}
+
+	tooMany := make([]string, maxTagsPerRun+1)
+	for i := range tooMany {
+		tooMany[i] = strings.Repeat("x", i+1)
+	}
+	for name, tags := range map[string][]string{
+		"empty":    {"ok", "  "},
+		"too long": {strings.Repeat("x", maxTagLen+1)},
+		"control":  {"a\nb"},
+		"too many": tooMany,
+	} {
+		if _, err := normalizeTags(tags); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRemoveTagRejectsInvalidTag(t *testing.T) {
+	h := newServer(appconfig.Defaults(), nil, nil).routes()
+	for _, tag := range []string{"%20%20", "a%0Ab"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/runs/"+uuid.NewString()+"/tags/"+tag, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("DELETE tag %q: status %d, want 400", tag, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv names the environment variable that points at a YAML config file. The
+// --config flag takes precedence over it.
+const ConfigFileEnv = "CONFIG_FILE"
+
+const redacted = "REDACTED"
+
+// Load builds the effective settings from, in increasing order of precedence:
+// built-in defaults, the YAML config file, environment variables (including .env, or
+// .env.test when RUN_HANDLER_ENV=test) and command-line flags in args. The settings are
+// validated before they are returned. The arguments left after the flags, such as a
+// subcommand, are returned as well. If args asks for help, the error is flag.ErrHelp.
+func Load(args []string) (Settings, []string, error) {
+	if os.Getenv("RUN_HANDLER_ENV") == "test" {
+		_ = godotenv.Load(".env.test")
+	} else {
+		_ = godotenv.Load(".env")
+	}
+
+	fs := flag.NewFlagSet("run-handler", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(ConfigFileEnv), "path to a YAML config file (env "+ConfigFileEnv+")")
+	flagValues := map[string]string{}
+	for _, f := range fields(&Settings{}) {
+		fs.Var(&rawFlag{values: flagValues, key: f.key, isBool: f.v.Kind() == reflect.Bool}, strings.ReplaceAll(f.key, "_", "-"), "overrides "+f.env)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Settings{}, nil, err
+	}
+
+	s := Defaults()
+	s.ConfigFile = *configFile
+	if *configFile != "" {
+		if err := s.applyFile(*configFile); err != nil {
+			return Settings{}, nil, err
+		}
+	}
+	var errs []error
+	for _, f := range fields(&s) {
+		// A variable set to the empty string clears a string setting, so that defaults
+		// such as S3_ENDPOINT_URL can be removed; other types have no empty value.
+		if v, ok := os.LookupEnv(f.env); ok && (v != "" || f.v.Kind() == reflect.String) {
+			if err := f.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("env %s: %w", f.env, err))
+			}
+		}
+		if v, ok := flagValues[f.key]; ok {
+			if err := f.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("flag --%s: %w", strings.ReplaceAll(f.key, "_", "-"), err))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Settings{}, nil, err
+	}
+	s.fillDevCredentials()
+	if err := s.Validate(); err != nil {
+		return Settings{}, nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return s, fs.Args(), nil
+}
+
+// applyFile overlays the keys set in the YAML file at path. Unknown keys are errors so
+// that typos do not silently fall back to defaults.
+func (s *Settings) applyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	var raw map[string]string
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	byKey := map[string]field{}
+	for _, f := range fields(s) {
+		byKey[f.key] = f
+	}
+	var errs []error
+	for key, v := range raw {
+		f, ok := byKey[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("config file %s: unknown key %q", path, key))
+			continue
+		}
+		if err := f.set(v); err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RedactedYAML renders the settings as a YAML config file, in field order, with
+// secrets that are set replaced by REDACTED.
+func (s Settings) RedactedYAML() ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, f := range fields(&s) {
+		val := &yaml.Node{Kind: yaml.ScalarNode, Value: f.String()}
+		switch {
+		case f.secret && val.Value != "":
+			val.Value = redacted
+		case f.v.Kind() == reflect.String:
+			// Quote strings so that values like "5432" or "on" keep their type.
+			val.Style = yaml.DoubleQuotedStyle
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.key}, val)
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// field is one settable entry of Settings.
+type field struct {
+	env    string
+	key    string
+	secret bool
+	reload bool
+	v      reflect.Value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// fields lists the tagged fields of s in declaration order.
+func fields(s *Settings) []field {
+	rv := reflect.ValueOf(s).Elem()
+	rt := rv.Type()
+	out := make([]field, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		env := sf.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		out = append(out, field{
+			env:    env,
+			key:    strings.ToLower(env),
+			secret: sf.Tag.Get("secret") == "true",
+			reload: sf.Tag.Get("reload") == "true",
+			v:      rv.Field(i),
+		})
+	}
+	return out
+}
+
+// set parses v according to the field's type.
+func (f field) set(v string) error {
+	switch {
+	case f.v.Type() == durationType:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q (want e.g. 500ms, 30s, 5m)", v)
+		}
+		f.v.SetInt(int64(d))
+	case f.v.Kind() == reflect.String:
+		f.v.SetString(v)
+	case f.v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		f.v.SetInt(int64(n))
+	case f.v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q (want true or false)", v)
+		}
+		f.v.SetBool(b)
+	case f.v.Kind() == reflect.Float64:
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		f.v.SetFloat(x)
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.v.Type())
+	}
+	return nil
+}
+
+// String formats the field's value the way set parses it.
+func (f field) String() string {
+	if f.v.Type() == durationType {
+		return time.Duration(f.v.Int()).String()
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+// rawFlag records a flag's raw value; flags are applied after the config file and env.
+type rawFlag struct {
+	values map[string]string
+	key    string
+	isBool bool
+}
+
+func (r *rawFlag) String() string { return "" }
+
+func (r *rawFlag) Set(v string) error {
+	r.values[r.key] = v
+	return nil
+}
+
+func (r *rawFlag) IsBoolFlag() bool { return r.isBool }
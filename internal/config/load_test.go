@@ -0,0 +1,139 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "port: 9000\ndb_host: file-host\ndb_name: file-db\nshutdown_timeout: 10s\n")
+	t.Setenv(ConfigFileEnv, path)
+	t.Setenv("DB_HOST", "env-host")
+	t.Setenv("DB_NAME", "env-db")
+
+	s, rest, err := Load([]string{"--db-name", "flag-db", "migrate", "up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Port != 9000 || s.ShutdownTimeout != 10*time.Second {
+		t.Errorf("file values not applied: port=%d shutdown_timeout=%s", s.Port, s.ShutdownTimeout)
+	}
+	if s.DBHost != "env-host" {
+		t.Errorf("env should override file, got db_host=%q", s.DBHost)
+	}
+	if s.DBName != "flag-db" {
+		t.Errorf("flag should override env, got db_name=%q", s.DBName)
+	}
+	if s.DBUser != Defaults().DBUser {
+		t.Errorf("unset key should keep its default, got db_user=%q", s.DBUser)
+	}
+	if strings.Join(rest, " ") != "migrate up" {
+		t.Errorf("remaining args = %q", rest)
+	}
+}
+
+func TestLoadEmptyEnvClearsSetting(t *testing.T) {
+	t.Setenv(ConfigFileEnv, "")
+	t.Setenv("S3_ENDPOINT_URL", "")
+	t.Setenv("S3_ACCESS_KEY", "")
+	t.Setenv("S3_SECRET_KEY", "")
+	t.Setenv("PORT", "")
+
+	s, _, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.S3Endpoint != "" {
+		t.Errorf("empty S3_ENDPOINT_URL should clear the default, got %q", s.S3Endpoint)
+	}
+	if s.S3AccessKey != "" || s.S3SecretKey != "" {
+		t.Error("development S3 keys filled in without a custom endpoint; the default chain would be skipped")
+	}
+	if s.Port != Defaults().Port {
+		t.Errorf("empty PORT should keep the default, got %d", s.Port)
+	}
+
+	t.Setenv("S3_ENDPOINT_URL", "http://localhost:9000")
+	if s, _, err = Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.S3AccessKey != devS3Key {
+		t.Error("development S3 keys not filled in for a custom endpoint")
+	}
+}
+
+func TestLoadRejectsBadInput(t *testing.T) {
+	cases := map[string]struct {
+		file string
+		env  map[string]string
+		want []string
+	}{
+		"unknown key":  {file: "prot: 80\n", want: []string{`unknown key "prot"`}},
+		"bad type":     {env: map[string]string{"ASYNC_WORKERS": "four"}, want: []string{"ASYNC_WORKERS", `invalid integer "four"`}},
+		"bad duration": {file: "readiness_timeout: 2\n", want: []string{"readiness_timeout", "invalid duration"}},
+		"invalid values": {
+			env:  map[string]string{"PORT": "70000", "TRACE_SAMPLE_RATIO": "1.5"},
+			want: []string{"port: must be a port", "trace_sample_ratio: must be between 0 and 1"},
+		},
+		"dev credentials in production": {
+			env:  map[string]string{"RUN_HANDLER_ENV": "production", "DB_PASSWORD": "postgres", "S3_ACCESS_KEY": "minioadmin1", "S3_SECRET_KEY": "minioadmin1"},
+			want: []string{"db_password", "s3_access_key"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if tc.file != "" {
+				t.Setenv(ConfigFileEnv, writeConfig(t, tc.file))
+			}
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			_, _, err := Load(nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, w := range tc.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("error %q does not mention %q", err, w)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactedYAML(t *testing.T) {
+	s := Defaults()
+	s.DBPassword = "hunter2"
+	s.S3SecretKey = ""
+	out, err := s.RedactedYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(out)
+	if strings.Contains(got, "hunter2") {
+		t.Fatalf("secret leaked:\n%s", got)
+	}
+	for _, want := range []string{"db_password: REDACTED\n", `s3_secret_key: ""` + "\n", "port: 8000\n", "shutdown_timeout: 30s\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+
+	// The output is itself a valid config file.
+	t.Setenv(ConfigFileEnv, writeConfig(t, strings.ReplaceAll(got, "REDACTED", `"x"`)))
+	if _, _, err := Load(nil); err != nil {
+		t.Errorf("printed config does not load: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package config
+
+// Change is one setting that differs between two Settings. Secret values are redacted.
+type Change struct {
+	Key        string
+	Old, New   string
+	Reloadable bool
+}
+
+// Diff lists the settings whose values differ between s and next, in field order.
+func (s Settings) Diff(next Settings) []Change {
+	var changes []Change
+	newFields := fields(&next)
+	for i, f := range fields(&s) {
+		old, cur := f.String(), newFields[i].String()
+		if old == cur {
+			continue
+		}
+		if f.secret {
+			old, cur = redacted, redacted
+		}
+		changes = append(changes, Change{Key: f.key, Old: old, New: cur, Reloadable: f.reload})
+	}
+	return changes
+}
+
+// WithReloadable returns s with every reloadable setting taken from next. Settings
+// that only take effect at startup keep their current values.
+func (s Settings) WithReloadable(next Settings) Settings {
+	out := s
+	src := fields(&next)
+	for i, f := range fields(&out) {
+		if f.reload {
+			f.v.Set(src[i].v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,43 @@
+package config
+
+import "testing"
+
+func TestDiffAndWithReloadable(t *testing.T) {
+	cur := Defaults()
+	next := cur
+	next.LogLevel = "debug"
+	next.Port = 9000
+	next.DBPassword = "rotated"
+
+	changes := cur.Diff(next)
+	byKey := map[string]Change{}
+	for _, c := range changes {
+		byKey[c.Key] = c
+	}
+	if len(changes) != 3 {
+		t.Fatalf("got %d changes, want 3: %+v", len(changes), changes)
+	}
+	if c := byKey["log_level"]; !c.Reloadable || c.Old != "info" || c.New != "debug" {
+		t.Errorf("log_level change = %+v", c)
+	}
+	if c := byKey["port"]; c.Reloadable {
+		t.Errorf("port should not be reloadable: %+v", c)
+	}
+	if c := byKey["db_password"]; c.Old != redacted || c.New != redacted {
+		t.Errorf("db_password change not redacted: %+v", c)
+	}
+
+	got := cur.WithReloadable(next)
+	if got.LogLevel != "debug" {
+		t.Errorf("log_level = %q, want debug", got.LogLevel)
+	}
+	if got.Port != cur.Port || got.DBPassword != cur.DBPassword {
+		t.Errorf("startup-only settings changed: port=%d db_password=%q", got.Port, got.DBPassword)
+	}
+	if cur.LogLevel != "info" {
+		t.Error("WithReloadable modified its receiver")
+	}
+	if len(Defaults().Diff(Defaults())) != 0 {
+		t.Error("identical settings should have no diff")
+	}
+}
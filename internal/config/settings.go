@@ -1,62 +1,368 @@
 package config
 
 import (
-	"os"
-
-	"github.com/joho/godotenv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
 )
 
-// Settings represents the application settings
+// Settings represents the application settings. Each field is named by its env tag:
+// the environment variable is the tag itself, the config-file key is its lower-case
+// form and the command-line flag uses dashes (DB_HOST, db_host, --db-host). Fields
+// tagged reload can be changed while the server runs.
 type Settings struct {
-	AppTitle       string
-	AppDescription string
-	AppVersion     string
-
-	DBHost     string
-	DBPort     string
-	DBUser     string
-	DBPassword string
-	DBName     string
-
-	S3BucketName string
-	S3Endpoint   string
-	S3AccessKey  string
-	S3SecretKey  string
-	S3Region     string
+	// ConfigFile is the YAML file the settings were loaded from, if any.
+	ConfigFile string
+
+	// ConfigReloadInterval is how often ConfigFile is checked for changes. Zero
+	// disables polling; SIGHUP always triggers a reload.
+	ConfigReloadInterval time.Duration `env:"CONFIG_RELOAD_INTERVAL"`
+
+	// Env is the deployment environment: development, test or production. Production
+	// refuses the built-in development credentials.
+	Env string `env:"RUN_HANDLER_ENV"`
+
+	AppTitle       string `env:"APP_TITLE"`
+	AppDescription string `env:"APP_DESCRIPTION"`
+	AppVersion     string `env:"APP_VERSION"`
+
+	// Port is the TCP port the HTTP server listens on.
+	Port int `env:"PORT"`
+
+	// MaxRequestBytes caps the body of POST /runs; MaxBatchRuns caps the runs in it
+	// (zero means no limit).
+	MaxRequestBytes int `env:"MAX_REQUEST_BYTES" reload:"true"`
+	MaxBatchRuns    int `env:"MAX_BATCH_RUNS" reload:"true"`
+
+	// MaxDecompressedBytes caps a gzip or zstd request body after decompression, which
+	// guards against decompression bombs. MaxRequestBytes still caps the bytes on the wire.
+	MaxDecompressedBytes int `env:"MAX_DECOMPRESSED_BYTES" reload:"true"`
+
+	// HTTP server timeouts. HTTPReadTimeout covers the whole request body and
+	// HTTPWriteTimeout the whole response, so both must allow for the largest batches
+	// and fields. Zero disables a timeout.
+	HTTPReadHeaderTimeout time.Duration `env:"HTTP_READ_HEADER_TIMEOUT"`
+	HTTPReadTimeout       time.Duration `env:"HTTP_READ_TIMEOUT"`
+	HTTPWriteTimeout      time.Duration `env:"HTTP_WRITE_TIMEOUT"`
+	HTTPIdleTimeout       time.Duration `env:"HTTP_IDLE_TIMEOUT"`
+
+	// HTTPCompression enables gzip/zstd response bodies for clients that accept them.
+	// Bodies shorter than HTTPCompressionMinBytes are sent uncompressed.
+	HTTPCompression         bool `env:"HTTP_COMPRESSION" reload:"true"`
+	HTTPCompressionMinBytes int  `env:"HTTP_COMPRESSION_MIN_BYTES" reload:"true"`
+
+	// RangeCacheBytes bounds the in-process LRU cache of field ranges read from S3; zero
+	// disables it. Ranges above RangeCacheMaxEntryBytes bypass the cache.
+	RangeCacheBytes         int `env:"RANGE_CACHE_BYTES"`
+	RangeCacheMaxEntryBytes int `env:"RANGE_CACHE_MAX_ENTRY_BYTES"`
+	// BatchCacheBytes bounds the memory holding recently written batch objects, which
+	// serve reads of fresh runs for up to BatchCacheTTL; zero disables it.
+	BatchCacheBytes int           `env:"BATCH_CACHE_BYTES"`
+	BatchCacheTTL   time.Duration `env:"BATCH_CACHE_TTL"`
+
+	// SearchTextBytes bounds the text extracted from a run's inputs and outputs for
+	// full-text search; zero disables indexing at ingest.
+	SearchTextBytes int `env:"SEARCH_TEXT_BYTES"`
+	// MetadataAttrKeys is a comma-separated allowlist of top-level metadata keys indexed
+	// for filtering; empty indexes every key. At most MetadataAttrMaxKeys scalar values
+	// per run are kept (zero disables indexing), and longer strings than
+	// MetadataAttrMaxValueBytes are skipped.
+	MetadataAttrKeys          string `env:"METADATA_ATTR_KEYS"`
+	MetadataAttrMaxKeys       int    `env:"METADATA_ATTR_MAX_KEYS"`
+	MetadataAttrMaxValueBytes int    `env:"METADATA_ATTR_MAX_VALUE_BYTES"`
+
+	// PresignThresholdBytes is the field size above which GET /runs/{id}?presign=true
+	// returns a presigned S3 URL valid for PresignTTL instead of the field's JSON.
+	PresignThresholdBytes int           `env:"PRESIGN_THRESHOLD_BYTES" reload:"true"`
+	PresignTTL            time.Duration `env:"PRESIGN_TTL" reload:"true"`
+
+	// RunCacheMaxAge is how long clients may reuse a completed run (one with outputs)
+	// without revalidating. Tags can change at any time, so the default of zero makes
+	// every read revalidate via its ETag.
+	RunCacheMaxAge time.Duration `env:"RUN_CACHE_MAX_AGE" reload:"true"`
+
+	// LogLevel is the minimum level logged: debug, info, warn or error.
+	LogLevel string `env:"LOG_LEVEL" reload:"true"`
+
+	DBHost     string `env:"DB_HOST"`
+	DBPort     string `env:"DB_PORT"`
+	DBUser     string `env:"DB_USER"`
+	DBPassword string `env:"DB_PASSWORD" secret:"true"`
+	DBName     string `env:"DB_NAME"`
+
+	// DBPasswordFile names a file holding the password, such as a mounted secret. It is
+	// read again for every new connection, so rotated passwords are picked up.
+	DBPasswordFile string `env:"DB_PASSWORD_FILE"`
+
+	// DBSSLMode is the libpq sslmode (disable, allow, prefer, require, verify-ca or
+	// verify-full). DBStatementTimeout is enforced by Postgres on every statement;
+	// zero leaves the server default.
+	DBSSLMode          string        `env:"DB_SSLMODE"`
+	DBMaxConns         int           `env:"DB_MAX_CONNS"`
+	DBMinConns         int           `env:"DB_MIN_CONNS"`
+	DBConnectTimeout   time.Duration `env:"DB_CONNECT_TIMEOUT"`
+	DBStatementTimeout time.Duration `env:"DB_STATEMENT_TIMEOUT"`
+
+	// DBAutoMigrate applies pending embedded migrations at startup.
+	DBAutoMigrate bool `env:"DB_AUTO_MIGRATE"`
+
+	S3BucketName string `env:"S3_BUCKET_NAME"`
+	S3Endpoint   string `env:"S3_ENDPOINT_URL"`
+	S3AccessKey  string `env:"S3_ACCESS_KEY" secret:"true"`
+	S3SecretKey  string `env:"S3_SECRET_KEY" secret:"true"`
+	S3Region     string `env:"S3_REGION"`
+
+	// S3AccessKeyFile and S3SecretKeyFile name files holding the S3 keys; they are read
+	// again every CredentialsRefreshInterval. Without keys or key files, the default AWS
+	// credential chain is used (environment, shared config, web identity, IMDS, ...).
+	S3AccessKeyFile            string        `env:"S3_ACCESS_KEY_FILE"`
+	S3SecretKeyFile            string        `env:"S3_SECRET_KEY_FILE"`
+	CredentialsRefreshInterval time.Duration `env:"CREDENTIALS_REFRESH_INTERVAL"`
+
+	// S3AutoCreateBucket creates S3BucketName at startup if it is missing.
+	S3AutoCreateBucket bool `env:"S3_AUTO_CREATE_BUCKET"`
+
+	// Batches estimated at or above S3MultipartThreshold bytes are streamed to S3 as a
+	// multipart upload in parts of S3MultipartPartSize bytes. Zero disables multipart.
+	S3MultipartThreshold int `env:"S3_MULTIPART_THRESHOLD" reload:"true"`
+	S3MultipartPartSize  int `env:"S3_MULTIPART_PART_SIZE" reload:"true"`
+
+	// ShutdownDelay is how long /healthz fails before the listener closes, giving load
+	// balancers time to notice. ShutdownTimeout bounds draining of in-flight requests.
+	ShutdownDelay   time.Duration `env:"SHUTDOWN_DELAY" reload:"true"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" reload:"true"`
+
+	// ReadinessTimeout bounds the dependency checks behind /readyz.
+	ReadinessTimeout time.Duration `env:"READINESS_TIMEOUT" reload:"true"`
+
+	// TraceExporter selects where OpenTelemetry spans go: "none", "stdout" or "otlp".
+	// TraceOTLPEndpoint overrides the OTLP/HTTP endpoint URL; when empty the standard
+	// OTEL_EXPORTER_OTLP_* variables apply.
+	TraceExporter     string  `env:"TRACE_EXPORTER"`
+	TraceOTLPEndpoint string  `env:"TRACE_OTLP_ENDPOINT"`
+	TraceSampleRatio  float64 `env:"TRACE_SAMPLE_RATIO"`
+
+	// AsyncIngest makes POST /runs append batches to a local write-ahead log and
+	// return 202 while background workers flush them to S3 and Postgres.
+	AsyncIngest    bool   `env:"ASYNC_INGEST"`
+	AsyncWALDir    string `env:"ASYNC_WAL_DIR"`
+	AsyncWorkers   int    `env:"ASYNC_WORKERS"`
+	AsyncQueueSize int    `env:"ASYNC_QUEUE_SIZE"`
+
+	// CoalesceWindow enables server-side micro-batching: small POST /runs requests arriving
+	// within the window share one batch object and one COPY. Zero disables it.
+	CoalesceWindow   time.Duration `env:"COALESCE_WINDOW" reload:"true"`
+	CoalesceMaxRuns  int           `env:"COALESCE_MAX_RUNS" reload:"true"`
+	CoalesceMaxBytes int           `env:"COALESCE_MAX_BYTES" reload:"true"`
 }
 
-// Load loads settings from environment variables, using .env or .env.test if present.
-// If RUN_HANDLER_ENV=test, it attempts to load .env.test first; otherwise .env.
-func Load() Settings {
-	env := os.Getenv("RUN_HANDLER_ENV")
-	if env == "test" {
-		_ = godotenv.Load(".env.test")
-	} else {
-		_ = godotenv.Load(".env")
+// Development credentials that match docker-compose-db.yaml. Outside production they
+// stand in for credentials that are not configured at all, so the server works out of
+// the box locally; production rejects them.
+const (
+	devDBPassword = "postgres"
+	devS3Key      = "minioadmin1"
+)
+
+// Defaults returns the settings used when nothing else is configured.
+func Defaults() Settings {
+	return Settings{
+		Env: "development",
+
+		ConfigReloadInterval: 10 * time.Second,
+
+		AppTitle:       "LS Run Handler",
+		AppDescription: "A simple Go server with run endpoints",
+		AppVersion:     "0.1.0",
+
+		Port: 8000,
+
+		MaxRequestBytes: 256 * 1024 * 1024,
+		MaxBatchRuns:    100_000,
+
+		MaxDecompressedBytes: 1024 * 1024 * 1024,
+
+		HTTPReadHeaderTimeout: 10 * time.Second,
+		HTTPReadTimeout:       2 * time.Minute,
+		HTTPWriteTimeout:      2 * time.Minute,
+		HTTPIdleTimeout:       2 * time.Minute,
+
+		HTTPCompression:         true,
+		HTTPCompressionMinBytes: 1024,
+
+		RangeCacheBytes:         64 * 1024 * 1024,
+		RangeCacheMaxEntryBytes: 1024 * 1024,
+		BatchCacheBytes:         128 * 1024 * 1024,
+		BatchCacheTTL:           time.Minute,
+
+		SearchTextBytes:           64 * 1024,
+		MetadataAttrMaxKeys:       32,
+		MetadataAttrMaxValueBytes: 256,
+
+		PresignThresholdBytes: 1024 * 1024,
+		PresignTTL:            5 * time.Minute,
+
+		RunCacheMaxAge: 0,
+
+		LogLevel: "info",
+
+		DBHost: "localhost",
+		DBPort: "5432",
+		DBUser: "postgres",
+		DBName: "postgres",
+
+		DBSSLMode:          "prefer",
+		DBMaxConns:         16,
+		DBMinConns:         2,
+		DBConnectTimeout:   5 * time.Second,
+		DBStatementTimeout: 30 * time.Second,
+
+		S3BucketName: "runs",
+		S3Endpoint:   "http://localhost:9000",
+		S3Region:     "us-east-1",
+
+		CredentialsRefreshInterval: 5 * time.Minute,
+
+		S3MultipartThreshold: 64 * 1024 * 1024,
+		S3MultipartPartSize:  16 * 1024 * 1024,
+
+		ShutdownTimeout: 30 * time.Second,
+
+		ReadinessTimeout: 2 * time.Second,
+
+		TraceExporter:    "none",
+		TraceSampleRatio: 1,
+
+		AsyncWALDir:    ".data/wal",
+		AsyncWorkers:   4,
+		AsyncQueueSize: 256,
+
+		CoalesceMaxRuns:  500,
+		CoalesceMaxBytes: 4 * 1024 * 1024,
 	}
+}
 
-	get := func(key, def string) string {
-		if v := os.Getenv(key); v != "" {
-			return v
+// Validate reports every invalid setting at once, naming each by its config key.
+func (s Settings) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
 		}
-		return def
+	}
+	port := func(key string, p int) {
+		check(p >= 1 && p <= 65535, key, "must be a port between 1 and 65535, got %d", p)
 	}
 
-	return Settings{
-		AppTitle:       get("APP_TITLE", "LS Run Handler"),
-		AppDescription: get("APP_DESCRIPTION", "A simple Go server with run endpoints"),
-		AppVersion:     get("APP_VERSION", "0.1.0"),
-
-		DBHost:     get("DB_HOST", "localhost"),
-		DBPort:     get("DB_PORT", "5432"),
-		DBUser:     get("DB_USER", "postgres"),
-		DBPassword: get("DB_PASSWORD", "postgres"),
-		DBName:     get("DB_NAME", "postgres"),
-
-		S3BucketName: get("S3_BUCKET_NAME", "runs"),
-		S3Endpoint:   get("S3_ENDPOINT_URL", "http://localhost:9000"),
-		S3AccessKey:  get("S3_ACCESS_KEY", "minioadmin1"),
-		S3SecretKey:  get("S3_SECRET_KEY", "minioadmin1"),
-		S3Region:     get("S3_REGION", "us-east-1"),
+	check(s.Env == "development" || s.Env == "test" || s.Env == "production", "run_handler_env",
+		"must be development, test or production, got %q", s.Env)
+	var lvl slog.Level
+	check(lvl.UnmarshalText([]byte(s.LogLevel)) == nil, "log_level", "must be debug, info, warn or error, got %q", s.LogLevel)
+	check(s.ConfigReloadInterval >= 0, "config_reload_interval", "must not be negative, got %s", s.ConfigReloadInterval)
+	port("port", s.Port)
+	check(s.MaxRequestBytes > 0, "max_request_bytes", "must be positive, got %d", s.MaxRequestBytes)
+	check(s.MaxDecompressedBytes > 0, "max_decompressed_bytes", "must be positive, got %d", s.MaxDecompressedBytes)
+	check(s.MaxBatchRuns >= 0, "max_batch_runs", "must not be negative, got %d", s.MaxBatchRuns)
+	check(s.HTTPReadHeaderTimeout >= 0, "http_read_header_timeout", "must not be negative, got %s", s.HTTPReadHeaderTimeout)
+	check(s.HTTPReadTimeout >= 0, "http_read_timeout", "must not be negative, got %s", s.HTTPReadTimeout)
+	check(s.HTTPWriteTimeout >= 0, "http_write_timeout", "must not be negative, got %s", s.HTTPWriteTimeout)
+	check(s.HTTPIdleTimeout >= 0, "http_idle_timeout", "must not be negative, got %s", s.HTTPIdleTimeout)
+	check(s.RangeCacheBytes >= 0, "range_cache_bytes", "must not be negative, got %d", s.RangeCacheBytes)
+	if s.RangeCacheBytes > 0 {
+		check(s.RangeCacheMaxEntryBytes > 0 && s.RangeCacheMaxEntryBytes <= s.RangeCacheBytes, "range_cache_max_entry_bytes",
+			"must be between 1 and range_cache_bytes (%d), got %d", s.RangeCacheBytes, s.RangeCacheMaxEntryBytes)
+	}
+	check(s.BatchCacheBytes >= 0, "batch_cache_bytes", "must not be negative, got %d", s.BatchCacheBytes)
+	check(s.BatchCacheBytes == 0 || s.BatchCacheTTL > 0, "batch_cache_ttl", "must be positive when batch_cache_bytes is set, got %s", s.BatchCacheTTL)
+	// A tsvector is limited to 1MiB.
+	check(s.SearchTextBytes >= 0 && s.SearchTextBytes <= 1024*1024, "search_text_bytes", "must be between 0 and 1048576, got %d", s.SearchTextBytes)
+	check(s.MetadataAttrMaxKeys >= 0, "metadata_attr_max_keys", "must not be negative, got %d", s.MetadataAttrMaxKeys)
+	check(s.MetadataAttrMaxValueBytes >= 0, "metadata_attr_max_value_bytes", "must not be negative, got %d", s.MetadataAttrMaxValueBytes)
+	check(s.PresignThresholdBytes >= 0, "presign_threshold_bytes", "must not be negative, got %d", s.PresignThresholdBytes)
+	// SigV4 presigned URLs are valid for at most seven days.
+	check(s.PresignTTL > 0 && s.PresignTTL <= 7*24*time.Hour, "presign_ttl", "must be between 1s and 168h, got %s", s.PresignTTL)
+	check(s.RunCacheMaxAge >= 0, "run_cache_max_age", "must not be negative, got %s", s.RunCacheMaxAge)
+	check(s.HTTPCompressionMinBytes >= 0, "http_compression_min_bytes", "must not be negative, got %d", s.HTTPCompressionMinBytes)
+
+	check(s.DBHost != "", "db_host", "is required")
+	dbPort, err := strconv.Atoi(s.DBPort)
+	check(err == nil, "db_port", "must be a number, got %q", s.DBPort)
+	if err == nil {
+		port("db_port", dbPort)
+	}
+	check(s.DBUser != "", "db_user", "is required")
+	check(s.DBName != "", "db_name", "is required")
+	switch s.DBSSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		check(false, "db_sslmode", "must be disable, allow, prefer, require, verify-ca or verify-full, got %q", s.DBSSLMode)
+	}
+	check(s.DBMaxConns >= 1, "db_max_conns", "must be at least 1, got %d", s.DBMaxConns)
+	check(s.DBMinConns >= 0 && s.DBMinConns <= s.DBMaxConns, "db_min_conns", "must be between 0 and db_max_conns (%d), got %d", s.DBMaxConns, s.DBMinConns)
+	check(s.DBConnectTimeout >= 0, "db_connect_timeout", "must not be negative, got %s", s.DBConnectTimeout)
+	check(s.DBStatementTimeout >= 0, "db_statement_timeout", "must not be negative, got %s", s.DBStatementTimeout)
+
+	check(s.S3BucketName != "", "s3_bucket_name", "is required")
+	check(s.S3Region != "", "s3_region", "is required")
+	if s.S3Endpoint != "" {
+		u, err := url.Parse(s.S3Endpoint)
+		check(err == nil && u.Scheme != "" && u.Host != "", "s3_endpoint_url", "must be an absolute URL, got %q", s.S3Endpoint)
+	}
+	check(s.S3MultipartThreshold >= 0, "s3_multipart_threshold", "must not be negative, got %d", s.S3MultipartThreshold)
+	if s.S3MultipartThreshold > 0 {
+		// S3 requires every part but the last to be at least 5 MiB.
+		check(s.S3MultipartPartSize >= 5*1024*1024, "s3_multipart_part_size", "must be at least 5MiB, got %d", s.S3MultipartPartSize)
+	}
+
+	check(s.ShutdownDelay >= 0, "shutdown_delay", "must not be negative, got %s", s.ShutdownDelay)
+	check(s.ShutdownTimeout > 0, "shutdown_timeout", "must be positive, got %s", s.ShutdownTimeout)
+	check(s.ReadinessTimeout > 0, "readiness_timeout", "must be positive, got %s", s.ReadinessTimeout)
+
+	check(s.TraceExporter == "none" || s.TraceExporter == "stdout" || s.TraceExporter == "otlp", "trace_exporter",
+		"must be none, stdout or otlp, got %q", s.TraceExporter)
+	check(s.TraceSampleRatio >= 0 && s.TraceSampleRatio <= 1, "trace_sample_ratio", "must be between 0 and 1, got %g", s.TraceSampleRatio)
+
+	if s.AsyncIngest {
+		check(s.AsyncWALDir != "", "async_wal_dir", "is required when async_ingest is on")
+		check(s.AsyncWorkers >= 1, "async_workers", "must be at least 1, got %d", s.AsyncWorkers)
+		check(s.AsyncQueueSize >= 1, "async_queue_size", "must be at least 1, got %d", s.AsyncQueueSize)
+	}
+	check(s.CoalesceWindow >= 0, "coalesce_window", "must not be negative, got %s", s.CoalesceWindow)
+	if s.CoalesceWindow > 0 {
+		check(s.CoalesceMaxRuns >= 1, "coalesce_max_runs", "must be at least 1, got %d", s.CoalesceMaxRuns)
+		check(s.CoalesceMaxBytes >= 1, "coalesce_max_bytes", "must be at least 1, got %d", s.CoalesceMaxBytes)
+	}
+
+	check(s.DBPassword == "" || s.DBPasswordFile == "", "db_password_file", "cannot be combined with db_password")
+	check((s.S3AccessKey == "") == (s.S3SecretKey == ""), "s3_secret_key", "s3_access_key and s3_secret_key must be set together")
+	check((s.S3AccessKeyFile == "") == (s.S3SecretKeyFile == ""), "s3_secret_key_file", "s3_access_key_file and s3_secret_key_file must be set together")
+	check(s.S3AccessKey == "" || s.S3AccessKeyFile == "", "s3_access_key_file", "cannot be combined with s3_access_key")
+	if s.S3AccessKeyFile != "" {
+		check(s.CredentialsRefreshInterval > 0, "credentials_refresh_interval", "must be positive, got %s", s.CredentialsRefreshInterval)
+	}
+
+	if s.Env == "production" {
+		check(s.DBPassword != devDBPassword, "db_password", "development credentials are not allowed in production")
+		check(s.S3AccessKey != devS3Key && s.S3SecretKey != devS3Key, "s3_access_key", "development credentials are not allowed in production")
+	}
+	return errors.Join(errs...)
+}
+
+// fillDevCredentials supplies the development credentials for any service that has
+// none configured, except in production. The MinIO keys are only filled in while
+// S3Endpoint points at a custom endpoint; against AWS itself unset keys must reach the
+// default credential chain.
+func (s *Settings) fillDevCredentials() {
+	if s.Env == "production" {
+		return
+	}
+	if s.DBPassword == "" && s.DBPasswordFile == "" {
+		s.DBPassword = devDBPassword
+	}
+	if s.S3Endpoint != "" && s.S3AccessKey == "" && s.S3SecretKey == "" && s.S3AccessKeyFile == "" && s.S3SecretKeyFile == "" {
+		s.S3AccessKey, s.S3SecretKey = devS3Key, devS3Key
 	}
 }
@@ -0,0 +1,122 @@
+// Package lru implements a byte-size bounded least-recently-used cache.
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// now is replaced in tests.
+var now = time.Now
+
+// Cache holds byte slices up to a total size, evicting the least recently used entries
+// first. With a TTL, entries also expire that long after they were added. It is safe for
+// concurrent use. Cached slices must not be modified.
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// New returns a cache that holds at most maxBytes of keys and values.
+func New(maxBytes int64) *Cache {
+	return &Cache{maxBytes: maxBytes, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// NewTTL returns a cache like New whose entries also expire ttl after they were added.
+func NewTTL(maxBytes int64, ttl time.Duration) *Cache {
+	c := New(maxBytes)
+	c.ttl = ttl
+	return c
+}
+
+// Get returns the value for key and marks it as recently used.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if c.expired(el.Value.(*entry), now()) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*entry).value, true
+}
+
+// Add stores value under key, evicting older entries as needed. Values larger than
+// the whole cache are not stored.
+func (c *Cache) Add(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cost := entrySize(key, value)
+	if cost > c.maxBytes {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	t := now()
+	e := &entry{key: key, value: value}
+	if c.ttl > 0 {
+		e.expires = t.Add(c.ttl)
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.size += cost
+	// Expired entries at the cold end go first, then whatever is needed to fit.
+	for back := c.ll.Back(); back != nil && c.expired(back.Value.(*entry), t); back = c.ll.Back() {
+		c.removeElement(back)
+	}
+	for c.size > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove drops key from the cache.
+func (c *Cache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Size returns the bytes currently held.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Len returns the number of entries.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Cache) expired(e *entry, t time.Time) bool {
+	return c.ttl > 0 && !t.Before(e.expires)
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*entry)
+	delete(c.items, e.key)
+	c.size -= entrySize(e.key, e.value)
+}
+
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
@@ -0,0 +1,89 @@
+package lru
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(30) // room for three 10-byte entries
+	val := []byte(strings.Repeat("x", 9))
+	c.Add("a", val)
+	c.Add("b", val)
+	c.Add("c", val)
+	if c.Size() != 30 || c.Len() != 3 {
+		t.Fatalf("size=%d len=%d, want 30 and 3", c.Size(), c.Len())
+	}
+
+	// Touch a so that b becomes the oldest.
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a missing")
+	}
+	c.Add("d", val)
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("%s should still be cached", k)
+		}
+	}
+}
+
+func TestCacheReplaceAndRemove(t *testing.T) {
+	c := New(100)
+	c.Add("k", []byte("one"))
+	c.Add("k", []byte("three"))
+	if v, _ := c.Get("k"); string(v) != "three" {
+		t.Fatalf("got %q", v)
+	}
+	if c.Size() != int64(len("k")+len("three")) {
+		t.Fatalf("size = %d after replace", c.Size())
+	}
+	c.Remove("k")
+	if _, ok := c.Get("k"); ok || c.Size() != 0 {
+		t.Fatal("remove did not drop the entry")
+	}
+}
+
+func TestCacheSkipsOversizedValues(t *testing.T) {
+	c := New(10)
+	c.Add("small", []byte("v"))
+	c.Add("big", make([]byte, 20))
+	if _, ok := c.Get("big"); ok {
+		t.Error("value larger than the cache was stored")
+	}
+	if _, ok := c.Get("small"); !ok {
+		t.Error("oversized value should not evict others")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	clock := time.Unix(0, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	c := NewTTL(100, time.Minute)
+	c.Add("a", []byte("1"))
+	clock = clock.Add(30 * time.Second)
+	c.Add("b", []byte("2"))
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a expired early")
+	}
+
+	clock = clock.Add(45 * time.Second) // a is 75s old, b 45s
+	if _, ok := c.Get("a"); ok {
+		t.Error("a should have expired")
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Error("b expired early")
+	}
+
+	// Adding sweeps expired entries from the cold end.
+	clock = clock.Add(time.Minute)
+	c.Add("c", []byte("3"))
+	if c.Len() != 1 || c.Size() != 2 {
+		t.Errorf("len=%d size=%d after sweep, want 1 and 2", c.Len(), c.Size())
+	}
+}
@@ -0,0 +1,227 @@
+// Package migrate applies the embedded SQL migrations to Postgres.
+//
+// It keeps its bookkeeping in the same schema_migrations table (version, dirty) that the
+// golang-migrate CLI uses, so the Makefile targets and the server can be mixed freely.
+// A session-level advisory lock serializes replicas that start at the same time.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// advisoryLockID is an arbitrary constant shared by every replica of the server.
+const advisoryLockID int64 = 0x6c735f72756e73 // "ls_runs"
+
+var fileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Load reads NNNN_name.up.sql / NNNN_name.down.sql pairs from fsys, sorted by version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("migrate: read migrations: %w", err)
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		m := fileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: bad version in %s: %w", e.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("migrate: read %s: %w", e.Name(), err)
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+	out := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migrate: version %d has no up migration", mig.Version)
+		}
+		out = append(out, *mig)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Latest returns the highest version in migs, or 0 if there are none.
+func Latest(migs []Migration) int64 {
+	if len(migs) == 0 {
+		return 0
+	}
+	return migs[len(migs)-1].Version
+}
+
+// Migrator applies migrations to one database.
+type Migrator struct {
+	pool *pgxpool.Pool
+	migs []Migration
+}
+
+// New returns a Migrator for migs, as returned by Load.
+func New(pool *pgxpool.Pool, migs []Migration) *Migrator {
+	return &Migrator{pool: pool, migs: migs}
+}
+
+// ErrDirty means a previous migration failed halfway and needs manual attention.
+var ErrDirty = errors.New("migrate: database is dirty")
+
+// Version returns the current schema version and dirty flag. A database that has never
+// been migrated reports version 0.
+func (m *Migrator) Version(ctx context.Context) (int64, bool, error) {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("migrate: acquire: %w", err)
+	}
+	defer conn.Release()
+	if err := ensureTable(ctx, conn.Conn()); err != nil {
+		return 0, false, err
+	}
+	return readVersion(ctx, conn.Conn())
+}
+
+// Up applies every pending migration and returns how many were applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+	err := m.locked(ctx, func(conn *pgx.Conn, current int64) error {
+		for _, mig := range m.migs {
+			if mig.Version <= current {
+				continue
+			}
+			if err := apply(ctx, conn, mig.Up, mig.Version); err != nil {
+				return fmt.Errorf("migrate: up %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the n most recent migrations and returns how many were reverted.
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	reverted := 0
+	err := m.locked(ctx, func(conn *pgx.Conn, current int64) error {
+		for i := len(m.migs) - 1; i >= 0 && reverted < n; i-- {
+			mig := m.migs[i]
+			if mig.Version > current {
+				continue
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("migrate: version %d has no down migration", mig.Version)
+			}
+			var prev int64
+			if i > 0 {
+				prev = m.migs[i-1].Version
+			}
+			if err := apply(ctx, conn, mig.Down, prev); err != nil {
+				return fmt.Errorf("migrate: down %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			current = prev
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// locked runs fn while holding the migration advisory lock on a dedicated connection.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *pgx.Conn, current int64) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate: acquire: %w", err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, advisoryLockID); err != nil {
+		return fmt.Errorf("migrate: lock: %w", err)
+	}
+	defer func() {
+		_, _ = conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, advisoryLockID)
+	}()
+
+	if err := ensureTable(ctx, conn.Conn()); err != nil {
+		return err
+	}
+	current, dirty, err := readVersion(ctx, conn.Conn())
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w at version %d", ErrDirty, current)
+	}
+	return fn(conn.Conn(), current)
+}
+
+// apply runs sql and records version in one transaction, so a failed migration leaves
+// neither a partial schema change nor a dirty marker behind.
+func apply(ctx context.Context, conn *pgx.Conn, sql string, version int64) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `TRUNCATE schema_migrations`); err != nil {
+		return err
+	}
+	if version > 0 {
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func ensureTable(ctx context.Context, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("migrate: create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func readVersion(ctx context.Context, conn *pgx.Conn) (int64, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+	err := conn.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("migrate: read version: %w", err)
+	}
+	return version, dirty, nil
+}
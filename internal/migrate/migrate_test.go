@@ -0,0 +1,50 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/langchain-ai/ls-go-run-handler/migrations"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_col.up.sql":   {Data: []byte("ALTER TABLE t ADD c int;")},
+		"0002_add_col.down.sql": {Data: []byte("ALTER TABLE t DROP c;")},
+		"0001_init.up.sql":      {Data: []byte("CREATE TABLE t (id int);")},
+		"0001_init.down.sql":    {Data: []byte("DROP TABLE t;")},
+		"README.md":             {Data: []byte("ignored")},
+	}
+	migs, err := Load(fsys)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(migs) != 2 || migs[0].Version != 1 || migs[1].Version != 2 {
+		t.Fatalf("unexpected migrations %+v", migs)
+	}
+	if migs[1].Name != "add_col" || migs[1].Down != "ALTER TABLE t DROP c;" {
+		t.Fatalf("unexpected migration %+v", migs[1])
+	}
+	if Latest(migs) != 2 {
+		t.Fatalf("expected latest 2, got %d", Latest(migs))
+	}
+
+	if _, err := Load(fstest.MapFS{"0003_x.down.sql": {Data: []byte("")}}); err == nil {
+		t.Fatalf("expected error for migration without up file")
+	}
+}
+
+func TestLoadEmbedded(t *testing.T) {
+	migs, err := Load(migrations.FS)
+	if err != nil {
+		t.Fatalf("load embedded: %v", err)
+	}
+	for i, m := range migs {
+		if m.Version != int64(i+1) {
+			t.Fatalf("embedded migrations are not contiguous: %+v", migs)
+		}
+		if m.Down == "" {
+			t.Fatalf("migration %d has no down file", m.Version)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package wal implements a small durable write-ahead log used to accept run batches
+// before they are flushed to object storage and Postgres.
+//
+// Each record lives in its own segment file so that flushed records can be dropped
+// independently. A segment is written to a temporary file, fsynced and atomically
+// renamed into place, so a crash never leaves a partially visible record.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	segmentExt = ".wal"
+	tmpExt     = ".tmp"
+	headerLen  = 8
+
+	// QuarantineDir is the subdirectory that unusable segments are moved to. Replay
+	// does not look into it.
+	QuarantineDir = "quarantine"
+)
+
+// ErrCorrupt is returned by Replay for segments whose checksum does not match.
+var ErrCorrupt = errors.New("wal: corrupt segment")
+
+// Record is one durable entry: opaque metadata plus the payload it describes.
+type Record struct {
+	Meta []byte
+	Body []byte
+}
+
+// Log is a directory of write-ahead log segments.
+type Log struct {
+	dir string
+}
+
+// Open creates dir if needed and removes temporary files left by an interrupted Append.
+func Open(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("wal: create dir: %w", err)
+	}
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+tmpExt))
+	if err != nil {
+		return nil, fmt.Errorf("wal: list dir: %w", err)
+	}
+	for _, p := range tmps {
+		_ = os.Remove(p)
+	}
+	return &Log{dir: dir}, nil
+}
+
+// Append durably stores rec under id. It returns once the record is on stable storage.
+func (l *Log) Append(id string, rec Record) error {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("wal: invalid record id %q", id)
+	}
+	var hdr [headerLen]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(rec.Meta)))
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(rec.Meta)
+	_, _ = crc.Write(rec.Body)
+	binary.BigEndian.PutUint32(hdr[4:8], crc.Sum32())
+
+	tmp := filepath.Join(l.dir, id+tmpExt)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: create segment: %w", err)
+	}
+	for _, b := range [][]byte{hdr[:], rec.Meta, rec.Body} {
+		if _, err := f.Write(b); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("wal: write segment: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("wal: sync segment: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("wal: close segment: %w", err)
+	}
+	if err := os.Rename(tmp, l.path(id)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("wal: commit segment: %w", err)
+	}
+	return l.syncDir()
+}
+
+// Remove drops the record stored under id. Removing a missing record is not an error.
+func (l *Log) Remove(id string) error {
+	if err := os.Remove(l.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("wal: remove segment: %w", err)
+	}
+	return nil
+}
+
+// Quarantine moves the segment stored under id out of the log, into QuarantineDir, so
+// that it is kept for inspection but no longer replayed. It returns the new path.
+func (l *Log) Quarantine(id string) (string, error) {
+	dir := filepath.Join(l.dir, QuarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("wal: create quarantine dir: %w", err)
+	}
+	dst := filepath.Join(dir, id+segmentExt)
+	if err := os.Rename(l.path(id), dst); err != nil {
+		return "", fmt.Errorf("wal: quarantine segment: %w", err)
+	}
+	return dst, l.syncDir()
+}
+
+// Replay calls fn for every stored record in lexical id order. Corrupt segments are
+// reported through fn's error argument so the caller can decide whether to drop or
+// quarantine them.
+func (l *Log) Replay(fn func(id string, rec Record, err error) error) error {
+	paths, err := filepath.Glob(filepath.Join(l.dir, "*"+segmentExt))
+	if err != nil {
+		return fmt.Errorf("wal: list dir: %w", err)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		id := strings.TrimSuffix(filepath.Base(p), segmentExt)
+		rec, readErr := readSegment(p)
+		if err := fn(id, rec, readErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSegment(path string) (Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Record{}, fmt.Errorf("wal: read segment: %w", err)
+	}
+	if len(data) < headerLen {
+		return Record{}, ErrCorrupt
+	}
+	metaLen := int(binary.BigEndian.Uint32(data[0:4]))
+	want := binary.BigEndian.Uint32(data[4:8])
+	payload := data[headerLen:]
+	if metaLen > len(payload) || crc32.ChecksumIEEE(payload) != want {
+		return Record{}, ErrCorrupt
+	}
+	return Record{Meta: payload[:metaLen], Body: payload[metaLen:]}, nil
+}
+
+func (l *Log) path(id string) string {
+	return filepath.Join(l.dir, id+segmentExt)
+}
+
+// syncDir makes the rename of a freshly committed segment durable.
+func (l *Log) syncDir() error {
+	d, err := os.Open(l.dir)
+	if err != nil {
+		return fmt.Errorf("wal: open dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("wal: sync dir: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+-- 0002_add_run_search.down.sql
+
+DROP INDEX IF EXISTS idx_runs_unindexed;
+DROP INDEX IF EXISTS idx_runs_search_vector;
+DROP TRIGGER IF EXISTS runs_search_vector_update ON runs;
+DROP FUNCTION IF EXISTS runs_search_vector_update();
+ALTER TABLE runs DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE runs DROP COLUMN IF EXISTS search_text;
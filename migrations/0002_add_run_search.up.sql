@@ -0,0 +1,29 @@
+-- 0002_add_run_search.up.sql
+-- Full-text search over run names and the text extracted from inputs and outputs.
+-- search_text is NULL until a run has been indexed, at ingest or by "search backfill".
+--
+-- search_vector is a plain nullable column kept up to date by a trigger rather than a
+-- generated column: adding a stored generated column rewrites the whole table under an
+-- ACCESS EXCLUSIVE lock, while adding a nullable column without a default does not.
+-- Runs stored before this migration get their vector when "search backfill" sets
+-- their search_text.
+
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS search_text TEXT;
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS search_vector tsvector;
+
+CREATE OR REPLACE FUNCTION runs_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', NEW.name), 'A') ||
+        setweight(to_tsvector('english', COALESCE(NEW.search_text, '')), 'B');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS runs_search_vector_update ON runs;
+CREATE TRIGGER runs_search_vector_update
+    BEFORE INSERT OR UPDATE OF name, search_text ON runs
+    FOR EACH ROW EXECUTE FUNCTION runs_search_vector_update();
+
+CREATE INDEX IF NOT EXISTS idx_runs_search_vector ON runs USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_runs_unindexed ON runs (id) WHERE search_text IS NULL;
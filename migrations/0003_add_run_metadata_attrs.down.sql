@@ -0,0 +1,6 @@
+-- 0003_add_run_metadata_attrs.down.sql
+
+DROP INDEX IF EXISTS idx_runs_created_at;
+DROP INDEX IF EXISTS idx_runs_metadata_attrs;
+ALTER TABLE runs DROP COLUMN IF EXISTS created_at;
+ALTER TABLE runs DROP COLUMN IF EXISTS metadata_attrs;
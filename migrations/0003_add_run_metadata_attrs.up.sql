@@ -0,0 +1,9 @@
+-- 0003_add_run_metadata_attrs.up.sql
+-- Top-level scalar metadata values extracted at ingest, so that runs can be listed and
+-- filtered by metadata without reading S3.
+
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS metadata_attrs JSONB;
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS idx_runs_metadata_attrs ON runs USING GIN (metadata_attrs);
+CREATE INDEX IF NOT EXISTS idx_runs_created_at ON runs (created_at DESC, id DESC);
@@ -0,0 +1,4 @@
+-- 0004_add_run_tags.down.sql
+
+DROP INDEX IF EXISTS idx_runs_tags;
+ALTER TABLE runs DROP COLUMN IF EXISTS tags;
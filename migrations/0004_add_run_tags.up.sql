@@ -0,0 +1,6 @@
+-- 0004_add_run_tags.up.sql
+-- Labels on runs, set at ingest and changed afterwards through /runs/{id}/tags.
+
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS idx_runs_tags ON runs USING GIN (tags);
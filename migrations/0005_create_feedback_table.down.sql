@@ -0,0 +1,3 @@
+-- 0005_create_feedback_table.down.sql
+
+DROP TABLE IF EXISTS feedback;
@@ -0,0 +1,16 @@
+-- 0005_create_feedback_table.up.sql
+-- Scores, labels and comments attached to runs, e.g. by evaluators or reviewers.
+
+CREATE TABLE IF NOT EXISTS feedback (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    run_id UUID NOT NULL REFERENCES runs(id) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    score DOUBLE PRECISION,
+    value JSONB,
+    comment TEXT,
+    source TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_feedback_run_id ON feedback (run_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_feedback_key_created_at ON feedback (key, created_at);
@@ -0,0 +1,9 @@
+// Package migrations embeds the SQL migrations so the server binary can apply them itself.
+package migrations
+
+import "embed"
+
+// FS holds the NNNN_name.up.sql / NNNN_name.down.sql files in this directory.
+//
+//go:embed *.sql
+var FS embed.FS